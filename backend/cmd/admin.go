@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+const adminUserColumns = `SELECT id, username, role, quota_bytes, used_bytes, disabled, totp_enabled, created_at,
+	(SELECT COUNT(*) FROM files WHERE owner_id = users.id AND deleted_at IS NULL)
+	FROM users`
+
+func scanAdminUser(row interface{ Scan(...any) error }) (AdminUserWrapper, error) {
+	var u AdminUserWrapper
+	var createdAt sql.NullTime
+	if err := row.Scan(&u.ID, &u.Username, &u.Role, &u.QuotaBytes, &u.UsedBytes, &u.Disabled, &u.TOTPEnabled, &createdAt, &u.FileCount); err != nil {
+		return u, err
+	}
+	if createdAt.Valid {
+		u.CreatedAt = &createdAt.Time
+	}
+	return u, nil
+}
+
+func listUsers(db *sql.DB) ([]AdminUserWrapper, error) {
+	users := make([]AdminUserWrapper, 0)
+
+	rows, err := db.Query(adminUserColumns + ` ORDER BY id`)
+	if err != nil {
+		log.Printf("Couldnt get users: %s", err.Error())
+		return users, err
+	}
+	defer rows.Close()
+
+	// Turn sql rows into structs
+	for rows.Next() {
+		u, err := scanAdminUser(rows)
+		if err != nil {
+			log.Printf("Couldnt scan user rows: %s", err.Error())
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+func getAdminUser(db *sql.DB, userId int) (AdminUserWrapper, error) {
+	return scanAdminUser(db.QueryRow(adminUserColumns+` WHERE id = ?`, userId))
+}
+
+func validateUserPatch(patch AdminUserPatchReq) error {
+	if patch.Role != nil && *patch.Role != "user" && *patch.Role != "admin" {
+		return invalidRequest("invalid role")
+	}
+	if patch.QuotaBytes != nil && *patch.QuotaBytes < 0 {
+		return invalidRequest("quota must not be negative")
+	}
+	if patch.Password != nil && *patch.Password == "" {
+		return invalidRequest("password must not be empty")
+	}
+	return nil
+}
+
+// patchUser applies the fields set in patch. Disabling a user or resetting
+// the password ends all of their sessions.
+func patchUser(db *sql.DB, userId int, patch AdminUserPatchReq) error {
+	// Check user exists
+	if _, err := getAdminUser(db, userId); err != nil {
+		return err
+	}
+
+	// Update fields
+	if patch.QuotaBytes != nil {
+		if _, err := db.Exec(`UPDATE users SET quota_bytes = ? WHERE id = ?`, *patch.QuotaBytes, userId); err != nil {
+			return err
+		}
+	}
+	if patch.Role != nil {
+		if _, err := db.Exec(`UPDATE users SET role = ? WHERE id = ?`, *patch.Role, userId); err != nil {
+			return err
+		}
+	}
+	if patch.Disabled != nil {
+		if _, err := db.Exec(`UPDATE users SET disabled = ? WHERE id = ?`, *patch.Disabled, userId); err != nil {
+			return err
+		}
+	}
+	if patch.Password != nil {
+		if err := setUserPassword(db, userId, *patch.Password); err != nil {
+			log.Println("Couldnt reset password")
+			return err
+		}
+	}
+
+	// End sessions
+	if (patch.Disabled != nil && *patch.Disabled) || patch.Password != nil {
+		if _, err := db.Exec(`DELETE FROM auth_tokens WHERE user_id = ?`, userId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit results
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+
+	AuditPageSize    = 50
+	AuditMaxPageSize = 500
+
+	// Fixed width, so stored timestamps sort as text
+	AuditTimeFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+// auditMu keeps reading the last hash and appending the next event atomic
+var auditMu sync.Mutex
+
+type AuditEvent struct {
+	ID        int64  `json:"id"`
+	CreatedAt string `json:"created_at"`
+	ActorID   *int   `json:"actor_id"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	IP        string `json:"ip"`
+	Result    string `json:"result"`
+	PrevHash  string `json:"prev_hash"`
+	Hash      string `json:"hash"`
+}
+
+// hashAuditEvent chains an event to the hash of the event before it. The id
+// is part of the hash, so deleting or reordering events breaks the chain.
+func hashAuditEvent(e AuditEvent) string {
+	actorId := ""
+	if e.ActorID != nil {
+		actorId = strconv.Itoa(*e.ActorID)
+	}
+	fields, _ := json.Marshal([]string{
+		strconv.FormatInt(e.ID, 10), e.CreatedAt, actorId, e.Actor, e.Action, e.Target, e.IP, e.Result, e.PrevHash,
+	})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordAudit appends an event to the audit log. actorId 0 means the actor is
+// unknown, actor is then used as given (e.g. the username of a failed login).
+func recordAudit(db *sql.DB, actorId int, actor, action, target, ip, result string) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	e := AuditEvent{
+		CreatedAt: time.Now().UTC().Format(AuditTimeFormat),
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		IP:        ip,
+		Result:    result,
+	}
+	if actorId != 0 {
+		e.ActorID = &actorId
+		if actor == "" {
+			db.QueryRow(`SELECT username FROM users WHERE id = ?`, actorId).Scan(&e.Actor)
+		}
+	}
+
+	// Chain to the last event
+	if err := db.QueryRow(`SELECT id, hash FROM audit_events ORDER BY id DESC LIMIT 1`).Scan(&e.ID, &e.PrevHash); err != nil && err != sql.ErrNoRows {
+		log.Printf("Couldnt get last audit event: %s", err.Error())
+		return
+	}
+	e.ID++
+	e.Hash = hashAuditEvent(e)
+
+	if _, err := db.Exec(`INSERT INTO audit_events (id, created_at, actor_id, actor, action, target, ip, result, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.ID, e.CreatedAt, e.ActorID, e.Actor, e.Action, e.Target, e.IP, e.Result, e.PrevHash, e.Hash); err != nil {
+		log.Printf("Couldnt record audit event %s: %s", action, err.Error())
+	}
+}
+
+// auditRequest records an event caused by the caller of r.
+func auditRequest(r *http.Request, actorId int, action, target, result string) {
+	recordAudit(DB, actorId, "", action, target, clientIP(r), result)
+}
+
+func auditResult(err error) string {
+	if err != nil {
+		return AuditFailure
+	}
+	return AuditSuccess
+}
+
+func scanAuditEvents(rows *sql.Rows) ([]AuditEvent, error) {
+	events := make([]AuditEvent, 0)
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEvent
+		var actorId sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &actorId, &e.Actor, &e.Action, &e.Target, &e.IP, &e.Result, &e.PrevHash, &e.Hash); err != nil {
+			return events, err
+		}
+		if actorId.Valid {
+			id := int(actorId.Int64)
+			e.ActorID = &id
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// listAuditEvents returns the newest events matching the filter, starting
+// before the event with id filter.BeforeID if it is set.
+func listAuditEvents(db *sql.DB, filter AuditFilter) ([]AuditEvent, error) {
+	conditions := make([]string, 0)
+	args := make([]any, 0)
+	if filter.BeforeID > 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, filter.BeforeID)
+	}
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action LIKE ?")
+		args = append(args, strings.ReplaceAll(filter.Action, "*", "%"))
+	}
+	if filter.Result != "" {
+		conditions = append(conditions, "result = ?")
+		args = append(args, filter.Result)
+	}
+	if filter.Target != "" {
+		conditions = append(conditions, "target = ?")
+		args = append(args, filter.Target)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From.UTC().Format(AuditTimeFormat))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.To.UTC().Format(AuditTimeFormat))
+	}
+
+	query := `SELECT id, created_at, actor_id, actor, action, target, ip, result, prev_hash, hash FROM audit_events`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, filter.Limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Couldnt get audit events: %s", err.Error())
+		return nil, err
+	}
+	return scanAuditEvents(rows)
+}
+
+// verifyAuditChain walks the whole log and returns the id of the first event
+// that doesnt match its hash or its predecessor, or 0 if the chain is intact.
+func verifyAuditChain(db *sql.DB) (int64, int, error) {
+	rows, err := db.Query(`SELECT id, created_at, actor_id, actor, action, target, ip, result, prev_hash, hash FROM audit_events ORDER BY id`)
+	if err != nil {
+		return 0, 0, err
+	}
+	events, err := scanAuditEvents(rows)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var prevId int64
+	var prevHash string
+	for _, e := range events {
+		if e.ID != prevId+1 || e.PrevHash != prevHash || hashAuditEvent(e) != e.Hash {
+			return e.ID, len(events), nil
+		}
+		prevId, prevHash = e.ID, e.Hash
+	}
+	return 0, len(events), nil
+}
+
+// exportAuditEvents writes the whole log as json lines, oldest first.
+func exportAuditEvents(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query(`SELECT id, created_at, actor_id, actor, action, target, ip, result, prev_hash, hash FROM audit_events ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	events, err := scanAuditEvents(rows)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	for _, e := range events {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseAuditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Target: query.Get("target"),
+		Result: query.Get("result"),
+		Limit:  AuditPageSize,
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return filter, invalidRequest("invalid limit")
+		}
+		filter.Limit = min(limit, AuditMaxPageSize)
+	}
+	if v := query.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return filter, invalidRequest("invalid before")
+		}
+		filter.BeforeID = before
+	}
+	if v := query.Get("from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, invalidRequest("invalid from")
+		}
+		filter.From = from
+	}
+	if v := query.Get("to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, invalidRequest("invalid to")
+		}
+		filter.To = to
+	}
+	return filter, nil
+}
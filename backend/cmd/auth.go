@@ -5,9 +5,9 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
-	"io"
 	"log"
-	"os"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -17,129 +17,142 @@ func generateRawToken() string {
 	return hex.EncodeToString(b)
 }
 
-func createInviteToken(db *sql.DB) (string, error) {
-	var token string
-	var err error
-	for {
-		// generate token
-		token = generateRawToken()
+// hashToken returns the value stored in the db for a raw token. Only hashes
+// are stored, raw tokens are shown to the client once when they are issued.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-		// check if token already exists
-		var tokenExists bool
-		db.QueryRow("SELECT EXISTS(SELECT 1 FROM invite_tokens WHERE token=?)", token).Scan(&tokenExists)
-		if tokenExists {
-			continue
-		}
+func createAuthToken(db *sql.DB, userId int, userAgent, ip string) (TokenWrapper, error) {
+	// generate access and refresh tokens
+	token, refreshToken := generateAuthTokenPair(db)
 
-		// create token if the token is unique
-		break
+	// set expiry dates
+	now := time.Now().UTC()
+	expiresAt := now.Add(Conf.AccessTokenTTL)
+	refreshExpiresAt := now.Add(Conf.RefreshTokenTTL)
+
+	// inster token in db, every login gets its own session
+	_, err := db.Exec(`INSERT INTO auth_tokens (token, refresh_token, token_hashed, session_id, user_id, created_at, last_used_at, expires_at, refresh_expires_at, user_agent, ip) VALUES (?, ?, 1, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(token), hashToken(refreshToken), generateSessionId(), userId, now, now, expiresAt, refreshExpiresAt, userAgent, ip)
+	if err != nil {
+		log.Println("Could not insert auth token")
+		return TokenWrapper{}, err
 	}
 
-	// set expiry date
-	expiresAt := time.Now().Add(InviteTokenValidHours * time.Hour).UTC()
+	return TokenWrapper{
+		Token:            token,
+		ExpiresAt:        expiresAt.String(),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt.String(),
+	}, nil
+}
 
-	// inster token in db
-	_, err = db.Exec(`INSERT INTO invite_tokens (token, expires_at) VALUES (?, ?)`, token, expiresAt)
+// refreshAuthToken exchanges a refresh token for a new access and refresh
+// token pair. The session keeps its id, the old pair stops working and the
+// refresh window slides forward.
+func refreshAuthToken(db *sql.DB, refreshToken, userAgent, ip string) (TokenWrapper, error) {
+	// generate access and refresh tokens
+	token, newRefreshToken := generateAuthTokenPair(db)
+
+	// set expiry dates
+	now := time.Now().UTC()
+	expiresAt := now.Add(Conf.AccessTokenTTL)
+	refreshExpiresAt := now.Add(Conf.RefreshTokenTTL)
+
+	// rotate tokens of the session if the refresh token is still valid
+	result, err := db.Exec(`UPDATE auth_tokens SET token = ?, refresh_token = ?, last_used_at = ?, expires_at = ?, refresh_expires_at = ?, user_agent = ?, ip = ? WHERE refresh_token = ? AND refresh_expires_at > ? AND user_id IN (SELECT id FROM users WHERE disabled = 0)`,
+		hashToken(token), hashToken(newRefreshToken), now, expiresAt, refreshExpiresAt, userAgent, ip, hashToken(refreshToken), now)
 	if err != nil {
-		log.Println("Could not insert invite token")
+		log.Println("Could not rotate auth token")
+		return TokenWrapper{}, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return TokenWrapper{}, sql.ErrNoRows
 	}
-	return token, err
-}
 
-func deleteInviteToken(db *sql.DB, inviteToken string) error {
-	_, err := db.Exec(`DELETE FROM invite_tokens WHERE token=?`, inviteToken)
-	return err
+	return TokenWrapper{
+		Token:            token,
+		ExpiresAt:        expiresAt.String(),
+		RefreshToken:     newRefreshToken,
+		RefreshExpiresAt: refreshExpiresAt.String(),
+	}, nil
 }
 
-func createAuthToken(db *sql.DB, userId int) (string, string, error) {
-	var token string = ""
-	var err error
+func generateAuthTokenPair(db *sql.DB) (string, string) {
+	var token, refreshToken string
 	for {
-		// generate token
+		// generate tokens
 		token = generateRawToken()
+		refreshToken = generateRawToken()
 
-		// check if token already exists
-		var tempUserId int
-		err1 := db.QueryRow("SELECT user_id FROM auth_tokens WHERE token=?", token).Scan(&tempUserId)
-		if err1 != sql.ErrNoRows {
+		// check if tokens already exist
+		var tokenExists bool
+		tokenHash, refreshTokenHash := hashToken(token), hashToken(refreshToken)
+		db.QueryRow("SELECT EXISTS(SELECT 1 FROM auth_tokens WHERE token IN (?, ?) OR refresh_token IN (?, ?))", tokenHash, refreshTokenHash, tokenHash, refreshTokenHash).Scan(&tokenExists)
+		if tokenExists {
 			continue
 		}
 
-		// check if user already has a token
-		var tempToken string
-		var tempExpiryDate time.Time
-		err2 := db.QueryRow("SELECT token, expires_at FROM auth_tokens WHERE user_id = ?", userId).Scan(&tempToken, &tempExpiryDate)
-		if err2 == nil {
-			// compare expiryDate with current time
-			if time.Now().After(tempExpiryDate) {
-				_, delErr := db.Exec("DELETE FROM auth_tokens WHERE user_id = ?", userId)
-				if delErr != nil {
-					log.Println("Could not delete auth token")
-					return "", "", delErr
-				}
-				break
-			}
-
-			// return token that user has and which isnt exired
-			return tempToken, tempExpiryDate.String(), nil
-
-		}
-
-		// break the loop if token is unique and user doesnt have any
+		// break the loop if tokens are unique
 		break
 	}
-
-	// set expiry date
-	expiresAt := time.Now().Add(6 * time.Hour).UTC()
-
-	// inster token in db
-	_, err = db.Exec(`INSERT INTO auth_tokens (token, user_id, expires_at) VALUES (?, ?, ?)`, token, userId, expiresAt)
-	if err != nil {
-		log.Println("Could not insert auth token")
-		return "", "", err
-	}
-
-	return token, expiresAt.String(), nil
+	return token, refreshToken
 }
 
-func authenticateAdmin(db *sql.DB, authToken string) (bool, error) {
-	// check if token exists
-	var userId int
-	err1 := db.QueryRow(`SELECT user_id FROM auth_tokens WHERE token = ?`, authToken).Scan(&userId)
-	if err1 != nil {
-		return false, err1
-	}
+// Principal is the caller of a request, resolved once from its auth token.
+type Principal struct {
+	UserID int
+	Role   string
+	// Token is the raw auth token, sessions look themselves up with it
+	Token string
+	// Sessions have every scope, personal access tokens only Scopes on the
+	// folder subtree Path
+	Session bool
+	Scopes  []string
+	Path    string
+}
 
-	//check is user is admin
-	var userRole string
-	err2 := db.QueryRow(`SELECT role FROM users WHERE id = ?`, userId).Scan(&userRole)
-	if err2 != nil {
-		return false, err2
-	}
+func (p *Principal) isAdmin() bool {
+	return p.Session && p.Role == "admin"
+}
 
-	return userRole == "admin", nil
+func (p *Principal) hasScope(scope string) bool {
+	return p.Session || slices.Contains(p.Scopes, scope)
 }
 
-func authenticateUser(db *sql.DB, authToken string) (int, error) {
-	var userId int
-	err := db.QueryRow(`SELECT user_id FROM auth_tokens WHERE token = ?`, authToken).Scan(&userId)
-	return userId, err
+// allows reports whether p may use scope on the folder at path.
+func (p *Principal) allows(scope, path string) bool {
+	return p.hasScope(scope) && (p.Session || pathInScope(path, p.Path))
 }
 
-func calculateFileSha256(path string) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		log.Printf("Error opening %s: %s", path, err.Error())
-		return "", err
+// LastUsedResolution is how exact last use times of tokens are, so not every
+// request writes to the db
+const LastUsedResolution = time.Minute
+
+// resolvePrincipal returns the caller an auth token belongs to, sql.ErrNoRows
+// if the token is unknown, expired or its user disabled.
+func resolvePrincipal(db *sql.DB, authToken string) (*Principal, error) {
+	if strings.HasPrefix(authToken, PersonalTokenPrefix) {
+		return resolvePersonalToken(db, authToken)
+	}
+
+	// Expired access tokens are rejected, the client has to refresh them
+	now := time.Now().UTC()
+	tokenHash := hashToken(authToken)
+	p := &Principal{Token: authToken, Session: true}
+	var lastUsed sql.NullTime
+	if err := db.QueryRow(`SELECT u.id, u.role, t.last_used_at FROM auth_tokens t JOIN users u ON u.id = t.user_id WHERE t.token = ? AND t.expires_at > ? AND u.disabled = 0`, tokenHash, now).Scan(&p.UserID, &p.Role, &lastUsed); err != nil {
+		return nil, err
 	}
-	defer f.Close()
 
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		log.Printf("Error calculating sha256 of %s: %s", path, err.Error())
-		return "", err
+	// Remember when the session was last used
+	if !lastUsed.Valid || now.Sub(lastUsed.Time) > LastUsedResolution {
+		if _, err := db.Exec(`UPDATE auth_tokens SET last_used_at = ? WHERE token = ?`, now, tokenHash); err != nil {
+			log.Printf("Couldnt update session usage: %s", err.Error())
+		}
 	}
 
-	sha256 := hex.EncodeToString(h.Sum(nil))
-	return sha256, nil
+	return p, nil
 }
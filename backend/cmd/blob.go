@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
+// BlobCollectInterval is how often blobs no file uses anymore are removed
+const BlobCollectInterval = time.Hour
+
+// blobMu orders storing and removing blobs on disk, so a blob isnt removed
+// while the same content is stored again. Rows using a blob need no lock, the
+// db refuses rows for blobs that are gone.
+var blobMu sync.Mutex
+
+func blobName(sha256 string) string {
+	return path.Join("blobs", sha256[:2], sha256)
+}
+
+// findUserBlob returns the blob with the content if a file or version of the
+// user has it, so the content isnt probed with uploads of other users.
+func findUserBlob(db *sql.DB, userId int, sha256 string, size int64) (string, error) {
+	var storedName string
+	err := db.QueryRow(`SELECT b.stored_name FROM blobs b WHERE b.sha256 = ?1 AND b.size_bytes = ?2 AND b.refs > 0 AND (
+		EXISTS(SELECT 1 FROM files WHERE stored_name = b.stored_name AND owner_id = ?3) OR
+		EXISTS(SELECT 1 FROM file_versions v JOIN files f ON f.uuid = v.file_uuid WHERE v.stored_name = b.stored_name AND f.owner_id = ?3)
+	) LIMIT 1`, sha256, size, userId).Scan(&storedName)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return storedName, err
+}
+
+// storeBlob makes the finished upload the content of the file uuid. Content
+// that is stored already is used instead and the upload removed.
+func storeBlob(db *sql.DB, uuid, upload, sha256 string, size int64) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	// Look for the content
+	var storedName string
+	err := db.QueryRow(`SELECT stored_name FROM blobs WHERE sha256 = ? AND size_bytes = ? LIMIT 1`, sha256, size).Scan(&storedName)
+	switch {
+	case err == sql.ErrNoRows:
+		// Move the upload to its blob
+		storedName = blobName(sha256)
+		if err := Store.Finalize(upload, storedName); err != nil {
+			return err
+		}
+		if _, err := db.Exec(`INSERT INTO blobs (stored_name, sha256, size_bytes, created_at) VALUES (?, ?, ?, ?)`, storedName, sha256, size, time.Now().UTC()); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		removeStoredFile(upload)
+	}
+
+	// Use it, a new blob stays unreferenced and is collected if this fails
+	_, err = db.Exec(`UPDATE files SET stored_name = ?, upload_expires_at = NULL WHERE uuid = ?`, storedName, uuid)
+	return err
+}
+
+// releaseStoredFiles removes stored files after rows using them were deleted.
+// Blobs are only removed once no file or version uses them, other files like
+// unfinished uploads right away. Failures are only logged, the files are
+// unreachable either way.
+func releaseStoredFiles(db *sql.DB, storedNames []string) {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	for _, name := range storedNames {
+		var isBlob bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM blobs WHERE stored_name = ?)`, name).Scan(&isBlob); err != nil {
+			log.Printf("Couldnt check blob %s: %s", name, err.Error())
+			continue
+		}
+		if !isBlob {
+			removeStoredFile(name)
+		}
+	}
+	if err := removeUnreferencedBlobs(db); err != nil {
+		log.Printf("Couldnt remove blobs: %s", err.Error())
+	}
+}
+
+// collectBlobs removes blobs that no file or version uses anymore.
+func collectBlobs(db *sql.DB) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	return removeUnreferencedBlobs(db)
+}
+
+func removeUnreferencedBlobs(db *sql.DB) error {
+	storedNames, err := queryStrings(db, `SELECT stored_name FROM blobs WHERE refs <= 0`)
+	if err != nil {
+		return err
+	}
+	for _, name := range storedNames {
+		// The row goes first, the db refuses new rows using it from then on
+		res, err := db.Exec(`DELETE FROM blobs WHERE stored_name = ? AND refs <= 0`, name)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			removeStoredFile(name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// runCommand runs a command line command instead of the server and returns
+// the exit code.
+func runCommand(args []string) int {
+	switch {
+	case len(args) >= 2 && args[0] == "audit" && args[1] == "export":
+		// Export to file or stdout
+		out := os.Stdout
+		if len(args) > 2 {
+			f, err := os.Create(args[2])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			defer f.Close()
+			out = f
+		}
+		if err := exportAuditEvents(DB, out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+
+	case len(args) == 2 && args[0] == "audit" && args[1] == "verify":
+		brokenId, count, err := verifyAuditChain(DB)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if brokenId != 0 {
+			fmt.Printf("Audit chain broken at event %d\n", brokenId)
+			return 2
+		}
+		fmt.Printf("Audit chain intact, %d events\n", count)
+		return 0
+
+	case len(args) == 2 && args[0] == "migrate" && args[1] == "status":
+		statuses, err := migrationStatus(DB)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d %-30s %s\n", s.Version, s.Name, state)
+		}
+		return 0
+
+	case len(args) >= 2 && len(args) <= 3 && args[0] == "migrate" && args[1] == "up":
+		// Migrate to a version or to the latest one
+		target := 0
+		if len(args) == 3 {
+			version, err := strconv.Atoi(args[2])
+			if err != nil || version < 1 {
+				fmt.Fprintln(os.Stderr, "Invalid version")
+				return 1
+			}
+			target = version
+		}
+		count, err := migrateUp(DB, target)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Applied %d migrations\n", count)
+		return 0
+
+	case len(args) >= 2 && len(args) <= 3 && args[0] == "migrate" && args[1] == "down":
+		// Revert the last migration or the given number of them
+		steps := 1
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 1 {
+				fmt.Fprintln(os.Stderr, "Invalid number of steps")
+				return 1
+			}
+			steps = n
+		}
+		count, err := migrateDown(DB, steps)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Reverted %d migrations\n", count)
+		return 0
+
+	case len(args) == 4 && args[0] == "storage" && args[1] == "migrate":
+		from, err := openStore(args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		to, err := openStore(args[3])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		count, err := migrateBlobs(DB, from, to, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Migrated %d blobs, set the storage driver to %s\n", count, args[3])
+		return 0
+
+	case len(args) == 2 && args[0] == "storage" && (args[1] == "encrypt" || args[1] == "decrypt" || args[1] == "rotate-keys"):
+		store, ok := Store.(*CryptStore)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "No encryption key is set")
+			return 1
+		}
+		var count int
+		var err error
+		switch args[1] {
+		case "encrypt":
+			count, err = encryptBlobs(DB, store, os.Stdout)
+		case "decrypt":
+			count, err = decryptBlobs(DB, store, os.Stdout)
+		default:
+			count, err = rotateKeys(DB, store)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Done with %d blobs\n", count)
+		return 0
+
+	case len(args) == 1 && args[0] == "seed":
+		if err := seedDB(DB); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("Added development users")
+		return 0
+
+	default:
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  drive                      run the server")
+		fmt.Fprintln(os.Stderr, "  drive migrate status       show applied and pending migrations")
+		fmt.Fprintln(os.Stderr, "  drive migrate up [version] apply pending migrations")
+		fmt.Fprintln(os.Stderr, "  drive migrate down [steps] revert the last migrations")
+		fmt.Fprintln(os.Stderr, "  drive seed                 add development users (never in production)")
+		fmt.Fprintln(os.Stderr, "  drive audit export [file]  export the audit log as json lines")
+		fmt.Fprintln(os.Stderr, "  drive audit verify         verify the audit hash chain")
+		fmt.Fprintln(os.Stderr, "  drive storage migrate <from> <to>")
+		fmt.Fprintln(os.Stderr, "                             copy blobs between local and s3 storage")
+		fmt.Fprintln(os.Stderr, "  drive storage encrypt      encrypt blobs stored in plain")
+		fmt.Fprintln(os.Stderr, "  drive storage decrypt      store all blobs in plain again")
+		fmt.Fprintln(os.Stderr, "  drive storage rotate-keys  wrap all data keys with the current master key")
+		return 1
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults, used when neither the config file, the environment nor a flag
+// sets a value
+const (
+	DefaultListen          = ":8000"
+	DefaultDBPath          = "./data/drive.db"
+	DefaultStorageRoot     = "./files"
+	DefaultQuotaBytes      = 25 * 1000 * 1000 * 1000
+	DefaultInviteTTL       = 24 * time.Hour
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 7 * 24 * time.Hour
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultTrashRetention  = 30 * 24 * time.Hour
+	DefaultVersionsKept    = 10
+	DefaultUploadTTL       = 24 * time.Hour
+	DefaultHSTSMaxAge      = 180 * 24 * time.Hour
+	DefaultStorageDriver   = DriverLocal
+	DefaultS3Region        = "us-east-1"
+	DefaultS3PartSize      = 16 << 20
+)
+
+type Config struct {
+	Listen            string        `yaml:"listen"`
+	DBPath            string        `yaml:"db_path"`
+	StorageRoot       string        `yaml:"storage_root"`
+	DefaultQuotaBytes int64         `yaml:"default_quota_bytes"`
+	InviteTTL         time.Duration `yaml:"invite_ttl"`
+	AccessTokenTTL    time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL   time.Duration `yaml:"refresh_token_ttl"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	TrashRetention    time.Duration `yaml:"trash_retention"`
+	VersionsKept      int64         `yaml:"versions_kept"`
+	UploadTTL         time.Duration `yaml:"upload_ttl"`
+	TLS               TLSConfig     `yaml:"tls"`
+	OIDC              OIDCConfig    `yaml:"oidc"`
+	Storage           StorageConfig `yaml:"storage"`
+}
+
+type TLSConfig struct {
+	Cert           string        `yaml:"cert"`
+	Key            string        `yaml:"key"`
+	SelfSigned     bool          `yaml:"self_signed"`
+	RedirectListen string        `yaml:"redirect_listen"`
+	HSTSMaxAge     time.Duration `yaml:"hsts_max_age"`
+}
+
+type StorageConfig struct {
+	Driver     string           `yaml:"driver"`
+	S3         S3Config         `yaml:"s3"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+}
+
+type S3Config struct {
+	Endpoint        string        `yaml:"endpoint"`
+	Region          string        `yaml:"region"`
+	Bucket          string        `yaml:"bucket"`
+	Prefix          string        `yaml:"prefix"`
+	AccessKeyID     string        `yaml:"access_key_id"`
+	SecretAccessKey string        `yaml:"secret_access_key"`
+	PathStyle       bool          `yaml:"path_style"`
+	PartSize        int64         `yaml:"part_size"`
+	PresignTTL      time.Duration `yaml:"presign_ttl"`
+}
+
+// EncryptionConfig sets the master keys blobs are encrypted with, base64
+// encoded 32 byte keys. Key is the current key if set, the key file has one
+// key per line and its first key is the current one otherwise.
+type EncryptionConfig struct {
+	Key     string `yaml:"key"`
+	KeyFile string `yaml:"key_file"`
+}
+
+func (c EncryptionConfig) enabled() bool {
+	return c.Key != "" || c.KeyFile != ""
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.Cert != "" || c.SelfSigned
+}
+
+var Conf Config
+
+func defaultConfig() Config {
+	return Config{
+		Listen:            DefaultListen,
+		DBPath:            DefaultDBPath,
+		StorageRoot:       DefaultStorageRoot,
+		DefaultQuotaBytes: DefaultQuotaBytes,
+		InviteTTL:         DefaultInviteTTL,
+		AccessTokenTTL:    DefaultAccessTokenTTL,
+		RefreshTokenTTL:   DefaultRefreshTokenTTL,
+		ShutdownTimeout:   DefaultShutdownTimeout,
+		TrashRetention:    DefaultTrashRetention,
+		VersionsKept:      DefaultVersionsKept,
+		UploadTTL:         DefaultUploadTTL,
+		TLS: TLSConfig{
+			HSTSMaxAge: DefaultHSTSMaxAge,
+		},
+		OIDC: OIDCConfig{
+			Scopes:      "openid profile email",
+			GroupsClaim: "groups",
+		},
+		Storage: StorageConfig{
+			Driver: DefaultStorageDriver,
+			S3: S3Config{
+				Region:   DefaultS3Region,
+				PartSize: DefaultS3PartSize,
+			},
+		},
+	}
+}
+
+// configValue binds a setting to its environment variable and flag.
+type configValue struct {
+	env, flag, usage string
+	target           any
+}
+
+func (v configValue) set(value string) error {
+	switch p := v.target.(type) {
+	case *string:
+		*p = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*p = b
+	case *int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*p = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*p = d
+	}
+	return nil
+}
+
+// flagValue keeps a flag as text until the config file and the environment
+// were applied.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (f *flagValue) String() string     { return f.value }
+func (f *flagValue) Set(v string) error { f.value = v; return nil }
+func (f *flagValue) IsBoolFlag() bool   { return f.isBool }
+
+func (c *Config) values() []configValue {
+	return []configValue{
+		{"DRIVE_LISTEN", "listen", "address to listen on", &c.Listen},
+		{"DRIVE_DB_PATH", "db", "path of the sqlite database", &c.DBPath},
+		{"DRIVE_STORAGE_ROOT", "storage", "directory for uploaded files, or unfinished uploads with s3", &c.StorageRoot},
+		{"DRIVE_STORAGE_DRIVER", "storage-driver", "where blobs are stored, local or s3", &c.Storage.Driver},
+		{"DRIVE_S3_ENDPOINT", "s3-endpoint", "url of the s3 service", &c.Storage.S3.Endpoint},
+		{"DRIVE_S3_REGION", "s3-region", "region of the bucket", &c.Storage.S3.Region},
+		{"DRIVE_S3_BUCKET", "s3-bucket", "bucket for blobs", &c.Storage.S3.Bucket},
+		{"DRIVE_S3_PREFIX", "s3-prefix", "prefix of keys in the bucket", &c.Storage.S3.Prefix},
+		{"DRIVE_S3_ACCESS_KEY_ID", "s3-access-key-id", "s3 access key id", &c.Storage.S3.AccessKeyID},
+		{"DRIVE_S3_SECRET_ACCESS_KEY", "", "", &c.Storage.S3.SecretAccessKey}, // no flag, it would show up in ps
+		{"DRIVE_S3_PATH_STYLE", "s3-path-style", "put the bucket in the path, for minio and most self hosted services", &c.Storage.S3.PathStyle},
+		{"DRIVE_S3_PART_SIZE", "s3-part-size", "size of multipart upload parts", &c.Storage.S3.PartSize},
+		{"DRIVE_S3_PRESIGN_TTL", "s3-presign-ttl", "redirect downloads to presigned urls valid this long, 0 serves them", &c.Storage.S3.PresignTTL},
+		{"DRIVE_ENCRYPTION_KEY", "", "", &c.Storage.Encryption.Key}, // no flag, it would show up in ps
+		{"DRIVE_ENCRYPTION_KEY_FILE", "encryption-key-file", "file of master keys blobs are encrypted with, the first is the current one", &c.Storage.Encryption.KeyFile},
+		{"DRIVE_DEFAULT_QUOTA_BYTES", "default-quota", "quota of users created without an invite", &c.DefaultQuotaBytes},
+		{"DRIVE_INVITE_TTL", "invite-ttl", "how long invites are valid", &c.InviteTTL},
+		{"DRIVE_ACCESS_TOKEN_TTL", "access-token-ttl", "how long access tokens are valid", &c.AccessTokenTTL},
+		{"DRIVE_REFRESH_TOKEN_TTL", "refresh-token-ttl", "how long refresh tokens are valid", &c.RefreshTokenTTL},
+		{"DRIVE_SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long running requests may finish on shutdown", &c.ShutdownTimeout},
+		{"DRIVE_TRASH_RETENTION", "trash-retention", "how long deleted files stay in the trash, 0 keeps them", &c.TrashRetention},
+		{"DRIVE_VERSIONS_KEPT", "versions-kept", "old versions kept per file", &c.VersionsKept},
+		{"DRIVE_UPLOAD_TTL", "upload-ttl", "how long unfinished uploads are kept after their last chunk", &c.UploadTTL},
+		{"DRIVE_TLS_CERT", "tls-cert", "pem certificate chain, enables https", &c.TLS.Cert},
+		{"DRIVE_TLS_KEY", "tls-key", "pem private key of the certificate", &c.TLS.Key},
+		{"DRIVE_TLS_SELF_SIGNED", "tls-self-signed", "generate a self-signed certificate if there is none", &c.TLS.SelfSigned},
+		{"DRIVE_TLS_REDIRECT_LISTEN", "tls-redirect-listen", "address to redirect plain http to https from", &c.TLS.RedirectListen},
+		{"DRIVE_HSTS_MAX_AGE", "hsts-max-age", "max-age of the Strict-Transport-Security header, 0 disables it", &c.TLS.HSTSMaxAge},
+		{"OIDC_ISSUER", "oidc-issuer", "issuer url of the openid connect provider", &c.OIDC.Issuer},
+		{"OIDC_CLIENT_ID", "oidc-client-id", "openid connect client id", &c.OIDC.ClientID},
+		{"OIDC_CLIENT_SECRET", "", "", &c.OIDC.ClientSecret}, // no flag, it would show up in ps
+		{"OIDC_REDIRECT_URL", "oidc-redirect-url", "openid connect callback url", &c.OIDC.RedirectURL},
+		{"OIDC_SCOPES", "oidc-scopes", "openid connect scopes", &c.OIDC.Scopes},
+		{"OIDC_GROUPS_CLAIM", "oidc-groups-claim", "claim holding the users groups", &c.OIDC.GroupsClaim},
+		{"OIDC_ALLOWED_GROUP", "oidc-allowed-group", "group whose members are created on first login", &c.OIDC.AllowedGroup},
+	}
+}
+
+// loadConfig builds the config from the defaults, the config file, the
+// environment and the flags, in that order, and returns the arguments left
+// after the flags. With a config file, relative paths from the file and the
+// default paths are resolved against its directory, otherwise against the
+// working directory.
+func loadConfig(args []string) (Config, []string, bool, error) {
+	config := defaultConfig()
+
+	// Flags are parsed first to find the config file, but applied last
+	flags := flag.NewFlagSet("drive", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("DRIVE_CONFIG"), "path of a yaml config file")
+	printConfig := flags.Bool("print-config", false, "print the effective config and exit")
+	values := config.values()
+	flagValues := make(map[string]*flagValue)
+	for _, v := range values {
+		if v.flag != "" {
+			_, isBool := v.target.(*bool)
+			flagValues[v.flag] = &flagValue{isBool: isBool}
+			flags.Var(flagValues[v.flag], v.flag, v.usage+" ("+v.env+")")
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return config, nil, false, err
+	}
+
+	// Config file
+	if *configPath != "" {
+		content, err := os.ReadFile(*configPath)
+		if err != nil {
+			return config, nil, false, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil {
+			return config, nil, false, fmt.Errorf("%s: %w", *configPath, err)
+		}
+		configDir := filepath.Dir(*configPath)
+		for _, p := range config.paths() {
+			if *p != "" && !filepath.IsAbs(*p) {
+				*p = filepath.Join(configDir, *p)
+			}
+		}
+	}
+
+	// Environment, then flags
+	for _, v := range values {
+		if env, ok := os.LookupEnv(v.env); ok {
+			if err := v.set(env); err != nil {
+				return config, nil, false, fmt.Errorf("%s: %w", v.env, err)
+			}
+		}
+	}
+	var errFlag error
+	flags.Visit(func(f *flag.Flag) {
+		for _, v := range values {
+			if v.flag == f.Name && errFlag == nil {
+				if err := v.set(flagValues[v.flag].value); err != nil {
+					errFlag = fmt.Errorf("-%s: %w", v.flag, err)
+				}
+			}
+		}
+	})
+	if errFlag != nil {
+		return config, nil, false, errFlag
+	}
+
+	// A generated certificate is kept next to the db
+	if config.TLS.SelfSigned && config.TLS.Cert == "" && config.TLS.Key == "" {
+		config.TLS.Cert = filepath.Join(filepath.Dir(config.DBPath), "tls-cert.pem")
+		config.TLS.Key = filepath.Join(filepath.Dir(config.DBPath), "tls-key.pem")
+	}
+
+	// Absolute paths
+	for _, p := range config.paths() {
+		if *p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return config, nil, false, err
+		}
+		*p = abs
+	}
+	config.OIDC.Issuer = strings.TrimSuffix(config.OIDC.Issuer, "/")
+
+	return config, flags.Args(), *printConfig, config.validate()
+}
+
+func (c *Config) paths() []*string {
+	return []*string{&c.DBPath, &c.StorageRoot, &c.TLS.Cert, &c.TLS.Key, &c.Storage.Encryption.KeyFile}
+}
+
+func (c Config) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen address %q", c.Listen)
+	}
+	if c.DefaultQuotaBytes < 0 {
+		return errors.New("default quota must not be negative")
+	}
+	if c.InviteTTL <= 0 || c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 {
+		return errors.New("token lifetimes must be positive")
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown timeout must not be negative")
+	}
+	if c.TrashRetention < 0 {
+		return errors.New("trash retention must not be negative")
+	}
+	if c.VersionsKept < 0 {
+		return errors.New("versions kept must not be negative")
+	}
+	if c.UploadTTL <= 0 {
+		return errors.New("upload ttl must be positive")
+	}
+	if c.RefreshTokenTTL < c.AccessTokenTTL {
+		return errors.New("refresh tokens must live at least as long as access tokens")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls needs both a certificate and a key")
+	}
+	if c.TLS.RedirectListen != "" {
+		if !c.TLS.enabled() {
+			return errors.New("redirecting to https needs tls")
+		}
+		if _, _, err := net.SplitHostPort(c.TLS.RedirectListen); err != nil {
+			return fmt.Errorf("invalid redirect listen address %q", c.TLS.RedirectListen)
+		}
+	}
+	if c.TLS.HSTSMaxAge < 0 {
+		return errors.New("hsts max age must not be negative")
+	}
+	if c.OIDC.Issuer != "" && !c.OIDC.enabled() {
+		return errors.New("oidc needs an issuer, client id and redirect url")
+	}
+	switch c.Storage.Driver {
+	case DriverLocal:
+	case DriverS3:
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" || c.Storage.S3.Region == "" {
+			return errors.New("s3 storage needs an endpoint, bucket and region")
+		}
+	default:
+		return fmt.Errorf("unknown storage driver %q", c.Storage.Driver)
+	}
+	if c.Storage.S3.PartSize < S3MinPartSize {
+		return fmt.Errorf("s3 part size must be at least %d", S3MinPartSize)
+	}
+	if c.Storage.S3.PresignTTL < 0 || c.Storage.S3.PresignTTL > 7*24*time.Hour {
+		return errors.New("s3 presign ttl must be between 0 and 7 days")
+	}
+	if c.Storage.Encryption.enabled() && c.Storage.S3.PresignTTL > 0 {
+		return errors.New("encrypted blobs cant be downloaded from presigned urls, set the s3 presign ttl to 0")
+	}
+	return nil
+}
+
+// String returns the config as yaml, with secrets left out.
+func (c Config) String() string {
+	if c.OIDC.ClientSecret != "" {
+		c.OIDC.ClientSecret = "<redacted>"
+	}
+	if c.Storage.S3.SecretAccessKey != "" {
+		c.Storage.S3.SecretAccessKey = "<redacted>"
+	}
+	if c.Storage.Encryption.Key != "" {
+		c.Storage.Encryption.Key = "<redacted>"
+	}
+	out, _ := yaml.Marshal(c)
+	return string(out)
+}
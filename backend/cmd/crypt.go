@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CryptChunkSize is how much content is encrypted at once. Chunks are
+// decrypted on their own, so ranges only read the chunks they need.
+const CryptChunkSize = 64 << 10
+
+// cryptOverhead is the size of the tag every chunk gets
+const cryptOverhead = 16
+
+// uploadOverhead is the size of the nonce and tag every chunk of an upload
+// gets
+const uploadOverhead = 12 + cryptOverhead
+
+var errBlobCorrupt = errors.New("blob is corrupt or was changed")
+
+// masterKey wraps the data keys of blobs. Its id is derived from the key, so
+// keys dont need names.
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// loadMasterKeys returns the configured master keys, the first one wraps new
+// data keys.
+func loadMasterKeys(conf EncryptionConfig) ([]masterKey, error) {
+	var encoded []string
+	if conf.Key != "" {
+		encoded = append(encoded, conf.Key)
+	}
+	if conf.KeyFile != "" {
+		content, err := os.ReadFile(conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				encoded = append(encoded, line)
+			}
+		}
+	}
+
+	keys := make([]masterKey, 0, len(encoded))
+	for i, e := range encoded {
+		raw, err := base64.StdEncoding.DecodeString(e)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("master key %d isnt 32 base64 encoded bytes", i+1)
+		}
+		aead, err := newGCM(raw)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(raw)
+		keys = append(keys, masterKey{id: hex.EncodeToString(sum[:8]), aead: aead})
+	}
+	return keys, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrap encrypts a data key, bind is the name of the blob the key is bound to
+// or empty for keys stored before keys were bound.
+func (k masterKey) wrap(dataKey, bind []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize())
+	rand.Read(nonce)
+	return k.aead.Seal(nonce, nonce, dataKey, append([]byte(k.id), bind...))
+}
+
+func (k masterKey) unwrap(wrapped, bind []byte) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(wrapped) < size {
+		return nil, errBlobCorrupt
+	}
+	dataKey, err := k.aead.Open(nil, wrapped[:size], wrapped[size:], append([]byte(k.id), bind...))
+	if err != nil {
+		return nil, errBlobCorrupt
+	}
+	return dataKey, nil
+}
+
+// CryptStore encrypts the blobs of another store. Every blob is encrypted
+// with a data key of its own in chunks of CryptChunkSize with AES-GCM, the
+// data keys are kept in the db wrapped with a master key. Unfinished uploads
+// have a data key too, their chunks get random nonces since an append seals
+// the chunk it starts in again. Keys and chunks are bound to the name of the
+// blob, a blob that is renamed is encrypted again. Blobs and uploads stored
+// before encryption was enabled are read in plain.
+type CryptStore struct {
+	inner BlobStore
+	db    *sql.DB
+	keys  []masterKey
+}
+
+// chunkCount returns the number of chunks of size bytes of content, empty
+// content has one empty chunk so it cant be cut off unnoticed.
+func chunkCount(size int64) int64 {
+	return max(1, (size+CryptChunkSize-1)/CryptChunkSize)
+}
+
+// cryptSize returns the stored size of size bytes of content.
+func cryptSize(size int64) int64 {
+	return size + cryptOverhead*chunkCount(size)
+}
+
+// chunkNonce is the index of the chunk, a data key only ever encrypts one
+// blob. The last chunk is marked, so a blob cant be cut off at a chunk.
+func chunkNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// chunkAAD binds a chunk to the name of its blob, bind is empty for keys that
+// arent bound.
+func chunkAAD(bind []byte, last bool) []byte {
+	if last {
+		return append(slices.Clip(bind), 1)
+	}
+	return append(slices.Clip(bind), 0)
+}
+
+// uploadChunkAAD binds a chunk of an upload to its name and index, so chunks
+// cant be reordered. Uploads cut off at a chunk fail their checksum when
+// finished.
+func uploadChunkAAD(bind []byte, index int64) []byte {
+	return binary.BigEndian.AppendUint64(slices.Clip(bind), uint64(index))
+}
+
+// openUploadChunk decrypts a chunk of an upload, stored as nonce and sealed
+// content, and appends it to dst.
+func openUploadChunk(aead cipher.AEAD, dst, bind []byte, index int64, sealed []byte) ([]byte, error) {
+	size := aead.NonceSize()
+	if len(sealed) < size+aead.Overhead() {
+		return nil, errBlobCorrupt
+	}
+	plain, err := aead.Open(dst, sealed[:size], sealed[size:], uploadChunkAAD(bind, index))
+	if err != nil {
+		return nil, errBlobCorrupt
+	}
+	return plain, nil
+}
+
+// dataKey returns the data key of a blob, the size of its content and what
+// its chunks are bound to. found is false for blobs and uploads stored in
+// plain.
+func (s *CryptStore) dataKey(name string) (aead cipher.AEAD, size int64, bind []byte, found bool, err error) {
+	var keyId string
+	var wrapped []byte
+	var bound bool
+	err = s.db.QueryRow(`SELECT key_id, wrapped_key, size_bytes, bound FROM blob_keys WHERE stored_name = ?`, name).Scan(&keyId, &wrapped, &size, &bound)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil, false, nil
+	}
+	if err != nil {
+		return nil, 0, nil, false, err
+	}
+	if bound {
+		bind = []byte(name)
+	}
+
+	key, err := s.masterKey(keyId)
+	if err != nil {
+		return nil, 0, nil, false, err
+	}
+	dataKey, err := key.unwrap(wrapped, bind)
+	if err != nil {
+		return nil, 0, nil, false, fmt.Errorf("%s: %w", name, err)
+	}
+	aead, err = newGCM(dataKey)
+	return aead, size, bind, true, err
+}
+
+func (s *CryptStore) masterKey(id string) (masterKey, error) {
+	for _, key := range s.keys {
+		if key.id == id {
+			return key, nil
+		}
+	}
+	return masterKey{}, fmt.Errorf("master key %s isnt configured", id)
+}
+
+// newDataKey returns a new data key and its cipher.
+func newDataKey() ([]byte, cipher.AEAD, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(dataKey)
+	return dataKey, aead, err
+}
+
+// storeDataKey stores the data key of name bound to it, wrapped with the
+// current master key, in place of the key it had.
+func (s *CryptStore) storeDataKey(name string, dataKey []byte, size int64) error {
+	_, err := s.db.Exec(`INSERT INTO blob_keys (stored_name, key_id, wrapped_key, size_bytes, created_at, bound) VALUES (?, ?, ?, ?, ?, 1)
+		ON CONFLICT(stored_name) DO UPDATE SET key_id = excluded.key_id, wrapped_key = excluded.wrapped_key, size_bytes = excluded.size_bytes, created_at = excluded.created_at, bound = 1`,
+		name, s.keys[0].id, s.keys[0].wrap(dataKey, []byte(name)), size, time.Now().UTC())
+	if err != nil {
+		log.Printf("Couldnt store key of %s: %s", name, err.Error())
+	}
+	return err
+}
+
+// Put encrypts r with a new data key. The key is stored once the content is,
+// so content stored before keeps its key when storing fails.
+func (s *CryptStore) Put(name string, r io.Reader, size int64) error {
+	dataKey, aead, err := newDataKey()
+	if err != nil {
+		return err
+	}
+
+	// Uploads are written by appends
+	if isUpload(name) {
+		if err := s.inner.Put(name, strings.NewReader(""), 0); err != nil {
+			return err
+		}
+		if err := s.storeDataKey(name, dataKey, 0); err != nil {
+			return err
+		}
+		written, err := s.Append(name, 0, io.LimitReader(r, size))
+		if err == nil && written != size {
+			err = fmt.Errorf("put %s: got %d of %d bytes", name, written, size)
+		}
+		return err
+	}
+
+	if err := s.inner.Put(name, &encryptReader{aead: aead, bind: []byte(name), r: r, size: size, chunks: chunkCount(size)}, cryptSize(size)); err != nil {
+		return err
+	}
+	return s.storeDataKey(name, dataKey, size)
+}
+
+// Append seals the chunk offset is in again, with the content before offset
+// and r. The size of the key is the size of the upload, clients resume at
+// the offset a successful append ended at.
+func (s *CryptStore) Append(name string, offset int64, r io.Reader) (int64, error) {
+	aead, size, bind, found, err := s.dataKey(name)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return s.inner.Append(name, offset, r)
+	}
+	if offset > size {
+		return 0, fmt.Errorf("append to %s at %d after its end at %d", name, offset, size)
+	}
+
+	// Keep the content of the chunk before offset
+	index := offset / CryptChunkSize
+	start := index * (CryptChunkSize + uploadOverhead)
+	var sealed, prefix []byte
+	if offset > index*CryptChunkSize {
+		body, err := s.inner.Get(name, start, CryptChunkSize+uploadOverhead)
+		if err != nil {
+			return 0, err
+		}
+		sealed, err = io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return 0, err
+		}
+		plain, err := openUploadChunk(aead, nil, bind, index, sealed)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+		if int64(len(plain)) < offset-index*CryptChunkSize {
+			return 0, fmt.Errorf("%s: %w", name, errBlobCorrupt)
+		}
+		prefix = plain[:offset-index*CryptChunkSize]
+	}
+
+	e := &uploadEncryptReader{aead: aead, bind: bind, r: io.MultiReader(bytes.NewReader(prefix), r), index: index}
+	if _, err := s.inner.Append(name, start, e); err != nil {
+		// Put the chunk back, so the append can be sent again
+		if _, errRestore := s.inner.Append(name, start, bytes.NewReader(sealed)); errRestore != nil {
+			log.Printf("Couldnt restore %s: %s", name, errRestore.Error())
+		}
+		return 0, err
+	}
+	written := e.read - int64(len(prefix))
+	if _, err := s.db.Exec(`UPDATE blob_keys SET size_bytes = ? WHERE stored_name = ?`, offset+written, name); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+func (s *CryptStore) Finalize(upload, name string) error {
+	info, err := s.Stat(upload)
+	if err != nil {
+		return err
+	}
+	r, err := s.Get(upload, 0, -1)
+	if err != nil {
+		return err
+	}
+	err = s.Put(name, r, info.Size)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return s.Delete(upload)
+}
+
+func (s *CryptStore) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	aead, size, bind, found, err := s.dataKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return s.inner.Get(name, offset, length)
+	}
+	stride := int64(CryptChunkSize + cryptOverhead)
+	if isUpload(name) {
+		stride = CryptChunkSize + uploadOverhead
+	}
+
+	// Read the chunks holding the range
+	offset = min(offset, size)
+	end := size
+	if length >= 0 {
+		end = min(offset+length, size)
+	}
+	if offset >= end {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	first, last := offset/CryptChunkSize, (end-1)/CryptChunkSize
+	body, err := s.inner.Get(name, first*stride, (last-first+1)*stride)
+	if err != nil {
+		return nil, err
+	}
+	d := &decryptReader{aead: aead, bind: bind, r: body, size: size, chunks: chunkCount(size), index: first, skip: offset - first*CryptChunkSize, upload: isUpload(name)}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(d, end-offset), body}, nil
+}
+
+func (s *CryptStore) Delete(name string) error {
+	err := s.inner.Delete(name)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		if _, errKey := s.db.Exec(`DELETE FROM blob_keys WHERE stored_name = ?`, name); errKey != nil {
+			return errKey
+		}
+	}
+	return err
+}
+
+func (s *CryptStore) Stat(name string) (BlobInfo, error) {
+	info, err := s.inner.Stat(name)
+	if err != nil {
+		return info, err
+	}
+	var size int64
+	err = s.db.QueryRow(`SELECT size_bytes FROM blob_keys WHERE stored_name = ?`, name).Scan(&size)
+	switch {
+	case err == nil:
+		info.Size = size
+	case err != sql.ErrNoRows:
+		return BlobInfo{}, err
+	}
+	return info, nil
+}
+
+// encryptReader reads size bytes of r encrypted in chunks.
+type encryptReader struct {
+	aead   cipher.AEAD
+	bind   []byte
+	r      io.Reader
+	size   int64
+	chunks int64
+	index  int64
+	buf    []byte
+	out    []byte
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.index >= e.chunks {
+			return 0, io.EOF
+		}
+		if e.buf == nil {
+			e.buf = make([]byte, CryptChunkSize+cryptOverhead)
+		}
+		n := min(CryptChunkSize, e.size-e.index*CryptChunkSize)
+		if _, err := io.ReadFull(e.r, e.buf[:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		e.out = e.aead.Seal(e.buf[:0], chunkNonce(e.index), e.buf[:n], chunkAAD(e.bind, e.index == e.chunks-1))
+		e.index++
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// uploadEncryptReader encrypts r in chunks of an upload from the chunk index
+// on and counts the bytes read.
+type uploadEncryptReader struct {
+	aead  cipher.AEAD
+	bind  []byte
+	r     io.Reader
+	index int64
+	read  int64
+	done  bool
+	buf   []byte
+	out   []byte
+}
+
+func (e *uploadEncryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if e.buf == nil {
+			e.buf = make([]byte, CryptChunkSize+uploadOverhead)
+		}
+		size := e.aead.NonceSize()
+		n, err := io.ReadFull(e.r, e.buf[size:size+CryptChunkSize])
+		e.read += int64(n)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			e.done = true
+		case err != nil:
+			return 0, err
+		}
+		if n == 0 {
+			return 0, io.EOF
+		}
+		if _, err := rand.Read(e.buf[:size]); err != nil {
+			return 0, err
+		}
+		e.out = e.aead.Seal(e.buf[:size], e.buf[:size], e.buf[size:size+n], uploadChunkAAD(e.bind, e.index))
+		e.index++
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// decryptReader decrypts chunks of a blob or upload from the chunk index on,
+// skipping the first skip bytes.
+type decryptReader struct {
+	aead   cipher.AEAD
+	bind   []byte
+	r      io.Reader
+	size   int64
+	chunks int64
+	index  int64
+	skip   int64
+	upload bool
+	buf    []byte
+	out    []byte
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.index >= d.chunks {
+			return 0, io.EOF
+		}
+		overhead := int64(cryptOverhead)
+		if d.upload {
+			overhead = uploadOverhead
+		}
+		if d.buf == nil {
+			d.buf = make([]byte, CryptChunkSize+overhead)
+		}
+		n := min(CryptChunkSize, d.size-d.index*CryptChunkSize) + overhead
+		if _, err := io.ReadFull(d.r, d.buf[:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		var plain []byte
+		var err error
+		if d.upload {
+			size := d.aead.NonceSize()
+			plain, err = openUploadChunk(d.aead, d.buf[size:size], d.bind, d.index, d.buf[:n])
+		} else {
+			plain, err = d.aead.Open(d.buf[:0], chunkNonce(d.index), d.buf[:n], chunkAAD(d.bind, d.index == d.chunks-1))
+		}
+		if err != nil {
+			return 0, errBlobCorrupt
+		}
+		d.out = plain[min(d.skip, int64(len(plain))):]
+		d.skip = 0
+		d.index++
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// encryptBlobs encrypts the blobs stored in plain. Blobs are checked by their
+// size, so an interrupted run can be run again.
+func encryptBlobs(db *sql.DB, store *CryptStore, progress io.Writer) (int, error) {
+	storedNames, err := queryStrings(db, `SELECT stored_name FROM blobs ORDER BY stored_name`)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, name := range storedNames {
+		info, err := store.inner.Stat(name)
+		if err != nil {
+			return count, fmt.Errorf("%s: %w", name, err)
+		}
+		var size int64
+		err = db.QueryRow(`SELECT size_bytes FROM blob_keys WHERE stored_name = ?`, name).Scan(&size)
+		if err != nil && err != sql.ErrNoRows {
+			return count, err
+		}
+		if err == nil && info.Size == cryptSize(size) {
+			continue
+		}
+
+		r, err := store.inner.Get(name, 0, -1)
+		if err != nil {
+			return count, fmt.Errorf("%s: %w", name, err)
+		}
+		err = store.Put(name, r, info.Size)
+		r.Close()
+		if err != nil {
+			return count, fmt.Errorf("%s: %w", name, err)
+		}
+		count++
+		fmt.Fprintf(progress, "encrypted %s\n", name)
+	}
+	return count, nil
+}
+
+// decryptBlobs stores every encrypted blob in plain again. The key is
+// removed after the blob, so an interrupted run can be run again.
+func decryptBlobs(db *sql.DB, store *CryptStore, progress io.Writer) (int, error) {
+	storedNames, err := queryStrings(db, `SELECT stored_name FROM blob_keys ORDER BY stored_name`)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, name := range storedNames {
+		var size int64
+		if err := db.QueryRow(`SELECT size_bytes FROM blob_keys WHERE stored_name = ?`, name).Scan(&size); err != nil {
+			return i, err
+		}
+		info, err := store.inner.Stat(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return i, fmt.Errorf("%s: %w", name, err)
+		}
+
+		// Keys of blobs that are gone are only removed
+		if err == nil && info.Size != size {
+			r, err := store.Get(name, 0, -1)
+			if err != nil {
+				return i, fmt.Errorf("%s: %w", name, err)
+			}
+			err = store.inner.Put(name, r, size)
+			r.Close()
+			if err != nil {
+				return i, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if _, err := db.Exec(`DELETE FROM blob_keys WHERE stored_name = ?`, name); err != nil {
+			return i, err
+		}
+		fmt.Fprintf(progress, "decrypted %s\n", name)
+	}
+	return len(storedNames), nil
+}
+
+// rotateKeys wraps the data keys of all blobs with the current master key.
+// Blobs arent rewritten, the old master keys can be removed afterwards.
+func rotateKeys(db *sql.DB, store *CryptStore) (int, error) {
+	current := store.keys[0]
+	storedNames, err := queryStrings(db, `SELECT stored_name FROM blob_keys WHERE key_id != ?`, current.id)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, name := range storedNames {
+		var keyId string
+		var wrapped []byte
+		var bound bool
+		if err := db.QueryRow(`SELECT key_id, wrapped_key, bound FROM blob_keys WHERE stored_name = ?`, name).Scan(&keyId, &wrapped, &bound); err != nil {
+			return i, err
+		}
+		var bind []byte
+		if bound {
+			bind = []byte(name)
+		}
+		key, err := store.masterKey(keyId)
+		if err != nil {
+			return i, fmt.Errorf("%s: %w", name, err)
+		}
+		dataKey, err := key.unwrap(wrapped, bind)
+		if err != nil {
+			return i, fmt.Errorf("%s: %w", name, err)
+		}
+		if _, err := db.Exec(`UPDATE blob_keys SET key_id = ?, wrapped_key = ? WHERE stored_name = ?`, current.id, current.wrap(dataKey, bind), name); err != nil {
+			return i, err
+		}
+	}
+	return len(storedNames), nil
+}
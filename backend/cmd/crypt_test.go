@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestCryptStore(t *testing.T) (*CryptStore, *LocalStore) {
+	t.Helper()
+	db := openTestDB(t)
+	keys, err := loadMasterKeys(EncryptionConfig{Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &LocalStore{root: t.TempDir()}
+	return &CryptStore{inner: inner, db: db, keys: keys}, inner
+}
+
+// failingReader returns its content and then an error, like a client that
+// goes away in the middle of a chunk.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestCryptStoreUploads(t *testing.T) {
+	s, inner := newTestCryptStore(t)
+	content := randomBytes(t, 3*CryptChunkSize+1000)
+
+	if err := s.Put("up.part", bytes.NewReader(nil), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appends that start and end inside chunks
+	for _, end := range []int{100, CryptChunkSize + 5, CryptChunkSize + 5, 2 * CryptChunkSize, len(content)} {
+		info, err := s.Stat("up.part")
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := info.Size
+		written, err := s.Append("up.part", offset, bytes.NewReader(content[offset:end]))
+		if err != nil || written != int64(end)-offset {
+			t.Fatalf("append %d-%d: wrote %d, %v", offset, end, written, err)
+		}
+	}
+
+	// Nothing is stored in plain
+	raw, err := os.ReadFile(inner.path("up.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, content[:64]) || bytes.Contains(raw, content[len(content)-64:]) {
+		t.Error("upload is stored in plain")
+	}
+	if got := readBlob(t, s, "up.part", 0, -1); !bytes.Equal(got, content) {
+		t.Fatal("upload reads back other content")
+	}
+	if got := readBlob(t, s, "up.part", CryptChunkSize-10, 20); !bytes.Equal(got, content[CryptChunkSize-10:CryptChunkSize+10]) {
+		t.Error("range across chunks differs")
+	}
+
+	// A failed append leaves the upload as it was
+	offset := int64(len(content) - 500)
+	if _, err := s.Append("up.part", offset, &failingReader{bytes.NewReader(randomBytes(t, 2*CryptChunkSize))}); err == nil {
+		t.Fatal("append of a failing reader succeeded")
+	}
+	if got := readBlob(t, s, "up.part", 0, -1); !bytes.Equal(got, content) {
+		t.Fatal("failed append changed the upload")
+	}
+
+	// Cutting off at offset, like a chunk that is too large
+	if _, err := s.Append("up.part", offset, bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := s.Stat("up.part"); err != nil || info.Size != offset {
+		t.Fatalf("stat after cutting off: %+v, %v", info, err)
+	}
+	if _, err := s.Append("up.part", offset+1, bytes.NewReader(nil)); err == nil {
+		t.Error("append after the end succeeded")
+	}
+	if _, err := s.Append("up.part", offset, bytes.NewReader(content[offset:])); err != nil {
+		t.Fatal(err)
+	}
+
+	// A changed chunk fails
+	raw, _ = os.ReadFile(inner.path("up.part"))
+	raw[CryptChunkSize+uploadOverhead+50] ^= 1
+	os.WriteFile(inner.path("up.part"), raw, 0o644)
+	if _, err := io.ReadAll(mustGet(t, s, "up.part")); !errors.Is(err, errBlobCorrupt) {
+		t.Errorf("changed upload: got %v, want errBlobCorrupt", err)
+	}
+	raw[CryptChunkSize+uploadOverhead+50] ^= 1
+	os.WriteFile(inner.path("up.part"), raw, 0o644)
+
+	// Finalizing encrypts it as a blob and removes the upload and its key
+	if err := s.Finalize("up.part", "blobs/aa/aa11"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, s, "blobs/aa/aa11", 0, -1); !bytes.Equal(got, content) {
+		t.Error("finalized blob differs")
+	}
+	var keys int
+	s.db.QueryRow(`SELECT COUNT(*) FROM blob_keys WHERE stored_name = 'up.part'`).Scan(&keys)
+	if _, err := inner.Stat("up.part"); err == nil || keys != 0 {
+		t.Errorf("upload left behind, %d keys", keys)
+	}
+}
+
+func TestCryptStorePlainUploads(t *testing.T) {
+	s, inner := newTestCryptStore(t)
+
+	// Uploads started before encryption was enabled stay in plain
+	if err := inner.Put("old.part", bytes.NewReader([]byte("plain ")), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append("old.part", 6, bytes.NewReader([]byte("upload"))); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := os.ReadFile(inner.path("old.part")); string(raw) != "plain upload" {
+		t.Errorf("plain upload is %q", raw)
+	}
+	if err := s.Finalize("old.part", "blobs/bb/bb22"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, s, "blobs/bb/bb22", 0, -1); string(got) != "plain upload" {
+		t.Errorf("finalized blob is %q", got)
+	}
+}
+
+func TestDecryptBlobsUploads(t *testing.T) {
+	s, inner := newTestCryptStore(t)
+	content := randomBytes(t, CryptChunkSize+10)
+	if err := s.Put("up.part", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decryptBlobs(s.db, s, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := os.ReadFile(inner.path("up.part")); !bytes.Equal(raw, content) {
+		t.Error("upload isnt stored in plain after decrypting")
+	}
+}
+
+func mustGet(t *testing.T, store BlobStore, name string) io.ReadCloser {
+	t.Helper()
+	r, err := store.Get(name, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestCryptStorePutFailure(t *testing.T) {
+	s, _ := newTestCryptStore(t)
+	content := randomBytes(t, CryptChunkSize+10)
+	if err := s.Put("blobs/aa/aa11", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Content and key that were stored before stay together
+	if err := s.Put("blobs/aa/aa11", &failingReader{bytes.NewReader(randomBytes(t, 100))}, 200); err == nil {
+		t.Fatal("put of a failing reader succeeded")
+	}
+	if got := readBlob(t, s, "blobs/aa/aa11", 0, -1); !bytes.Equal(got, content) {
+		t.Error("failed put changed the blob")
+	}
+}
+
+func TestCryptStoreBoundKeys(t *testing.T) {
+	s, inner := newTestCryptStore(t)
+	names := []string{"blobs/aa/aa11", "blobs/bb/bb22", "up.part"}
+	for _, name := range names {
+		content := randomBytes(t, 1000)
+		if err := s.Put(name, bytes.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A blob with the key and content of another one doesnt open
+	for _, other := range names[1:] {
+		raw, _ := os.ReadFile(inner.path(other))
+		os.WriteFile(inner.path(names[0]), raw, 0o644)
+		if _, err := s.db.Exec(`UPDATE blob_keys SET (key_id, wrapped_key, size_bytes) = (SELECT key_id, wrapped_key, size_bytes FROM blob_keys WHERE stored_name = ?) WHERE stored_name = ?`, other, names[0]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get(names[0], 0, -1); !errors.Is(err, errBlobCorrupt) {
+			t.Errorf("key of %s: got %v, want errBlobCorrupt", other, err)
+		}
+	}
+
+	// Neither does a blob with only the key of another one, whose data key
+	// is wrapped for this name
+	dataKey, aead, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := randomBytes(t, 1000)
+	e := &encryptReader{aead: aead, bind: []byte(names[1]), r: bytes.NewReader(content), size: int64(len(content)), chunks: 1}
+	if err := inner.Put(names[0], e, cryptSize(int64(len(content)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.storeDataKey(names[0], dataKey, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(mustGet(t, s, names[0])); !errors.Is(err, errBlobCorrupt) {
+		t.Errorf("chunks of another name: got %v, want errBlobCorrupt", err)
+	}
+
+	// Blobs cant be renamed with their key
+	if _, err := s.db.Exec(`INSERT INTO blobs (stored_name, sha256, size_bytes) VALUES (?, '', 0)`, names[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameBlob(s.db, names[1], "blobs/cc/cc33"); err == nil {
+		t.Error("renamed a blob with a bound key")
+	}
+}
+
+func TestCryptStoreUnboundKeys(t *testing.T) {
+	s, inner := newTestCryptStore(t)
+	dataKey, aead, err := newDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys stored before keys were bound are still read
+	content := randomBytes(t, CryptChunkSize+10)
+	e := &encryptReader{aead: aead, r: bytes.NewReader(content), size: int64(len(content)), chunks: chunkCount(int64(len(content)))}
+	if err := inner.Put("blobs/aa/aa11", e, cryptSize(int64(len(content)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec(`INSERT INTO blob_keys (stored_name, key_id, wrapped_key, size_bytes) VALUES (?, ?, ?, ?)`, "blobs/aa/aa11", s.keys[0].id, s.keys[0].wrap(dataKey, nil), len(content)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, s, "blobs/aa/aa11", 0, -1); !bytes.Equal(got, content) {
+		t.Error("unbound blob reads back other content")
+	}
+	if _, err := rotateKeys(s.db, s); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, s, "blobs/aa/aa11", 10, 20); !bytes.Equal(got, content[10:30]) {
+		t.Error("unbound blob differs after rotating keys")
+	}
+}
+
+func TestMigrateBoundBlobs(t *testing.T) {
+	from, inner := newTestCryptStore(t)
+	prevConf := Conf
+	t.Cleanup(func() { Conf = prevConf })
+	Conf = defaultConfig()
+	Conf.StorageRoot = inner.root
+
+	// A blob stored under an absolute path gets a key and is encrypted again
+	name := filepath.Join(inner.root, "legacy-file")
+	content := randomBytes(t, CryptChunkSize+10)
+	if err := from.Put(name, bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := from.db.Exec(`INSERT INTO blobs (stored_name, sha256, size_bytes) VALUES (?, '', ?)`, name, len(content)); err != nil {
+		t.Fatal(err)
+	}
+	to := &CryptStore{inner: &LocalStore{root: t.TempDir()}, db: from.db, keys: from.keys}
+	for i := 0; i < 2; i++ {
+		if _, err := migrateBlobs(from.db, from, to, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := queryStrings(from.db, `SELECT stored_name FROM blob_keys`)
+	if err != nil || strings.Join(keys, ",") != "legacy-file" {
+		t.Fatalf("keys after migrating: %v, %v", keys, err)
+	}
+	if got := readBlob(t, to, "legacy-file", 0, -1); !bytes.Equal(got, content) {
+		t.Error("migrated blob differs")
+	}
+}
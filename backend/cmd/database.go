@@ -2,8 +2,12 @@ package main
 
 import (
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
-	"os"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 func openDB(path string) (*sql.DB, error) {
@@ -17,11 +21,231 @@ func openDB(path string) (*sql.DB, error) {
 	return db, nil
 }
 
-func runSqlFromFile(db *sql.DB, path string) error {
-	sqlBytes, err := os.ReadFile(path)
+// isUniqueViolation reports whether err comes from a UNIQUE or PRIMARY KEY
+// constraint.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+// parseDBTime parses a timestamp stored as text by the sqlite driver or by
+// CURRENT_TIMESTAMP.
+func parseDBTime(value string) (time.Time, bool) {
+	value = strings.TrimSuffix(value, "Z")
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(format, value, time.UTC); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// upgradeLegacySchema brings tables created by init.sql, before there were
+// versioned migrations, up to the schema of the first migration. Later
+// schema changes belong in a new migration, not here.
+func upgradeLegacySchema(db *sql.DB) error {
+	// Sessions
+	if err := addColumnIfMissing(db, "auth_tokens", "session_id", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "auth_tokens", "last_used_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "auth_tokens", "user_agent", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "auth_tokens", "ip", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`UPDATE auth_tokens SET session_id = lower(hex(randomblob(16))) WHERE session_id IS NULL`); err != nil {
+		return err
+	}
+
+	// Refresh tokens
+	if err := addColumnIfMissing(db, "auth_tokens", "refresh_token", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "auth_tokens", "refresh_expires_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	// Token hashes
+	if err := addColumnIfMissing(db, "auth_tokens", "token_hashed", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "invite_tokens", "token_hashed", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := hashStoredTokens(db); err != nil {
+		return err
+	}
+
+	// Two factor authentication
+	if err := addColumnIfMissing(db, "users", "totp_secret", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// Invite settings
+	if err := addColumnIfMissing(db, "invite_tokens", "role", "TEXT NOT NULL DEFAULT 'user'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "invite_tokens", "quota_bytes", "INTEGER NOT NULL DEFAULT "+strconv.Itoa(DefaultQuotaBytes)); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "invite_tokens", "max_uses", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "invite_tokens", "uses", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "invite_tokens", "username", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "invite_tokens", "note", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "invite_tokens", "created_by", "INTEGER REFERENCES users(id) ON DELETE SET NULL"); err != nil {
+		return err
+	}
+
+	// Disabled accounts
+	if err := addColumnIfMissing(db, "users", "disabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// hashStoredTokens replaces raw tokens left by older versions with their
+// hashes, so existing sessions and invites keep working.
+func hashStoredTokens(db *sql.DB) error {
+	type rawToken struct {
+		token        string
+		refreshToken sql.NullString
+	}
+
+	// Collect raw auth tokens first, the db only has one connection
+	rows, err := db.Query(`SELECT token, refresh_token FROM auth_tokens WHERE token_hashed = 0`)
+	if err != nil {
+		return err
+	}
+	authTokens := make([]rawToken, 0)
+	for rows.Next() {
+		var t rawToken
+		if err := rows.Scan(&t.token, &t.refreshToken); err != nil {
+			rows.Close()
+			return err
+		}
+		authTokens = append(authTokens, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Collect raw invite tokens
+	rows, err = db.Query(`SELECT token FROM invite_tokens WHERE token_hashed = 0`)
+	if err != nil {
+		return err
+	}
+	inviteTokens := make([]string, 0)
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			return err
+		}
+		inviteTokens = append(inviteTokens, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Replace them in one transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, t := range authTokens {
+		var refreshTokenHash sql.NullString
+		if t.refreshToken.Valid {
+			refreshTokenHash = sql.NullString{String: hashToken(t.refreshToken.String), Valid: true}
+		}
+		if _, err := tx.Exec(`UPDATE auth_tokens SET token = ?, refresh_token = ?, token_hashed = 1 WHERE token = ? AND token_hashed = 0`,
+			hashToken(t.token), refreshTokenHash, t.token); err != nil {
+			return err
+		}
+	}
+	for _, token := range inviteTokens {
+		if _, err := tx.Exec(`UPDATE invite_tokens SET token = ?, token_hashed = 1 WHERE token = ? AND token_hashed = 0`, hashToken(token), token); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(string(sqlBytes))
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
 	return err
 }
+
+// dbQueryer is implemented by *sql.DB and *sql.Tx
+type dbQueryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// dbRowExecer is implemented by *sql.DB and *sql.Tx
+type dbRowExecer interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// queryStrings returns the first column of every row. The rows are closed
+// before it returns, so the caller can write on the same connection.
+func queryStrings(db dbQueryer, query string, args ...any) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestDB opens a migrated database in a temporary directory and makes it
+// the global DB for the duration of the test.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := openDB(filepath.Join(t.TempDir(), "drive.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateUp(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	prevDB := DB
+	DB = db
+	t.Cleanup(func() { DB = prevDB })
+	return db
+}
+
+func TestMigrationsRevert(t *testing.T) {
+	db := openTestDB(t)
+	indexes := func() string {
+		names, err := queryStrings(db, `SELECT name FROM sqlite_master WHERE type = 'index' AND name LIKE 'idx_auth_tokens_%' ORDER BY name`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(names, ",")
+	}
+
+	// Fresh databases get the indexes upgraded ones had
+	const want = "idx_auth_tokens_expiry,idx_auth_tokens_refresh,idx_auth_tokens_session,idx_auth_tokens_user"
+	if got := indexes(); got != want {
+		t.Errorf("indexes %s, want %s", got, want)
+	}
+
+	// Every migration can be reverted and applied again
+	list, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := migrateDown(db, len(list)); err != nil || n != len(list) {
+		t.Fatalf("reverted %d of %d migrations: %v", n, len(list), err)
+	}
+	if n, err := migrateUp(db, 0); err != nil || n != len(list) {
+		t.Fatalf("applied %d of %d migrations: %v", n, len(list), err)
+	}
+	if got := indexes(); got != want {
+		t.Errorf("indexes after migrating again %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MaxJSONBodyBytes limits request bodies that are decoded as json
+const MaxJSONBodyBytes = 1 << 20
+
+// APIError is the json body of every failed request. Code is stable and
+// meant for clients to switch on, Message is for humans.
+type APIError struct {
+	Status  int            `json:"-"`
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// withDetails returns a copy of e carrying details, e is often shared.
+func (e *APIError) withDetails(details map[string]any) *APIError {
+	c := *e
+	c.Details = details
+	return &c
+}
+
+var (
+	errInvalidJSON      = &APIError{Status: http.StatusBadRequest, Code: "invalid_json", Message: "Request body is not valid JSON"}
+	errEmptyBody        = &APIError{Status: http.StatusBadRequest, Code: "empty_body", Message: "Request body is empty"}
+	errUnauthorized     = &APIError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "Missing or invalid credentials"}
+	errInvalidLogin     = &APIError{Status: http.StatusUnauthorized, Code: "invalid_login", Message: "Invalid login"}
+	errForbidden        = &APIError{Status: http.StatusForbidden, Code: "forbidden", Message: "Not allowed"}
+	errNotFound         = &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "Not found"}
+	errMethodNotAllowed = &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "Method not allowed"}
+	errBodyTooLarge     = &APIError{Status: http.StatusRequestEntityTooLarge, Code: "body_too_large", Message: "Request body is too large"}
+	errTooManyAttempts  = &APIError{Status: http.StatusTooManyRequests, Code: "too_many_attempts", Message: "Too many attempts"}
+	errInternal         = &APIError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Internal server error"}
+	errQuotaExceeded    = &APIError{Status: http.StatusInsufficientStorage, Code: "quota_exceeded", Message: "Storage quota exceeded"}
+	errFileNotFound     = &APIError{Status: http.StatusNotFound, Code: "file_not_found", Message: "File not found"}
+	errFolderNotFound   = &APIError{Status: http.StatusNotFound, Code: "folder_not_found", Message: "Folder not found"}
+	errUploadNotFound   = &APIError{Status: http.StatusNotFound, Code: "upload_not_found", Message: "Upload not found"}
+	errUploadComplete   = &APIError{Status: http.StatusConflict, Code: "upload_complete", Message: "File was uploaded completely"}
+	errUploadIncomplete = &APIError{Status: http.StatusConflict, Code: "upload_incomplete", Message: "File wasnt uploaded completely"}
+	errChecksumMismatch = &APIError{Status: http.StatusConflict, Code: "checksum_mismatch", Message: "Uploaded file doesnt match its sha256"}
+	errUploadTooLarge   = &APIError{Status: http.StatusRequestEntityTooLarge, Code: "upload_too_large", Message: "Chunk goes past the announced file size"}
+	errUploadOffset     = &APIError{Status: http.StatusConflict, Code: "upload_offset_mismatch", Message: "Chunk doesnt start where the upload ends, resume at offset"}
+	errUploadExpired    = &APIError{Status: http.StatusGone, Code: "upload_expired", Message: "Upload expired, start it again"}
+	errUserNotFound     = &APIError{Status: http.StatusNotFound, Code: "user_not_found", Message: "User not found"}
+	errSessionNotFound  = &APIError{Status: http.StatusNotFound, Code: "session_not_found", Message: "Session not found"}
+	errTokenNotFound    = &APIError{Status: http.StatusNotFound, Code: "token_not_found", Message: "Token not found"}
+	errInviteNotFound   = &APIError{Status: http.StatusNotFound, Code: "invite_not_found", Message: "Invite not found"}
+	errInvalidInvite    = &APIError{Status: http.StatusUnauthorized, Code: "invalid_invite", Message: "Invalid invite"}
+	errInvalidRefresh   = &APIError{Status: http.StatusUnauthorized, Code: "invalid_refresh_token", Message: "Invalid refresh token"}
+	errUsernameTaken    = &APIError{Status: http.StatusConflict, Code: "username_taken", Message: "Username is taken"}
+	errLockoutNotFound  = &APIError{Status: http.StatusNotFound, Code: "lockout_not_found", Message: "No failed attempts for this key"}
+)
+
+// invalidRequest is a 400 for a request that is well formed but not valid.
+func invalidRequest(message string) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: "invalid_request", Message: message}
+}
+
+// writeError sends err as json. Errors that arent an APIError are logged and
+// answered with errInternal, so their text never reaches the client.
+func writeError(w http.ResponseWriter, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		log.Printf("Internal error: %s", err.Error())
+		apiErr = errInternal
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(apiErr)
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(wait.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, errTooManyAttempts.withDetails(map[string]any{"retry_after_seconds": seconds}))
+}
+
+// decodeJSON decodes the request body into v. An empty body is reported as
+// errEmptyBody, so handlers with optional bodies can accept it.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxJSONBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case err == io.EOF:
+			return errEmptyBody
+		case errors.As(err, &maxBytesErr):
+			return errBodyTooLarge.withDetails(map[string]any{"limit_bytes": maxBytesErr.Limit})
+		default:
+			return errInvalidJSON
+		}
+	}
+	return nil
+}
@@ -4,163 +4,356 @@ import (
 	"database/sql"
 	"errors"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-func startUpload(db *sql.DB, userId int, upload UploadReq) (string, error) {
+// UploadPurgeInterval is how often expired uploads are removed
+const UploadPurgeInterval = time.Hour
+
+// States of an upload
+const (
+	UploadUploading = "uploading"
+	UploadUploaded  = "uploaded"
+	UploadComplete  = "complete"
+	UploadExpired   = "expired"
+)
+
+// startUpload registers an upload of a new file, or of a new version of the
+// file upload.FileUUID, and reports whether it is complete already. Content
+// the user has stored before doesnt need to be uploaded again.
+func startUpload(db *sql.DB, userId int, upload UploadReq) (string, bool, error) {
 	// Process data
 	var folderId int
-	folderId, errGetFolder := getFolderIdFromPath(db, upload.Path, userId)
-	if errGetFolder != nil {
-		log.Println("Couldnt get folder id")
-		return "", errGetFolder
+	var replaces sql.NullString
+	if upload.FileUUID != "" {
+		// New versions keep folder and name of their file
+		if err := db.QueryRow(`SELECT folder_id, display_name FROM files WHERE uuid = ? AND owner_id = ? AND deleted_at IS NULL AND replaces IS NULL`, upload.FileUUID, userId).Scan(&folderId, &upload.Filename); err != nil {
+			log.Println("Couldnt get file to replace")
+			return "", false, errFileNotFound
+		}
+		replaces = sql.NullString{String: upload.FileUUID, Valid: true}
+	} else {
+		var errGetFolder error
+		folderId, errGetFolder = getFolderIdFromPath(db, upload.Path, userId)
+		if errGetFolder != nil {
+			log.Println("Couldnt get folder id")
+			return "", false, errGetFolder
+		}
 	}
 
 	// Reserve space in db
 	if err := reserveQuota(db, userId, upload.Size_bytes); err != nil {
 		log.Println("Couldnt reserve quota")
-		return "", err
+		return "", false, err
 	}
 
 	// Generate uuid
-	var uuid string
+	uuid := generateFileUUID(db)
+
+	// Content the user stored before is used, otherwise create empty temp file
+	sha256 := strings.ToLower(upload.Sha256)
+	storedName, err := findUserBlob(db, userId, sha256, upload.Size_bytes)
+	if err != nil {
+		releaseQuota(db, userId, upload.Size_bytes)
+		return "", false, err
+	}
+	complete, onDisk := storedName != "", upload.Size_bytes
+	var expiresAt *time.Time
+	if !complete {
+		expires := time.Now().UTC().Add(Conf.UploadTTL)
+		storedName, onDisk, expiresAt = uuid+".part", 0, &expires
+		if err := Store.Put(storedName, strings.NewReader(""), 0); err != nil {
+			log.Printf("Create tmp failed: %s", err.Error())
+			releaseQuota(db, userId, upload.Size_bytes)
+			return "", false, err
+		}
+	}
+
+	// Register file, a complete new version takes the place of its file
+	// right away
+	takeOver := complete && replaces.Valid
+	pruned, err := registerUpload(db, uuid, replaces.String, takeOver,
+		uuid, userId, folderId, storedName, upload.Filename, upload.Mime, upload.Size_bytes, onDisk, sha256, time.Now().UTC(), userId, replaces, expiresAt)
+	if err != nil {
+		log.Printf("Registration of file failed: %s", err.Error())
+		releaseQuota(db, userId, upload.Size_bytes)
+		if !complete {
+			Store.Delete(storedName)
+		}
+		return "", false, err
+	}
+	releaseStoredFiles(db, pruned)
+
+	// Return uuid
+	return uuid, complete, nil
+}
+
+// registerUpload inserts the row of an upload with the values of its columns.
+// With takeOver the upload becomes the current version of the file replaces
+// in the same transaction, so a failure leaves neither behind. It returns the
+// stored names of versions beyond the limit.
+func registerUpload(db *sql.DB, uuid, replaces string, takeOver bool, values ...any) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO files (uuid, owner_id, folder_id, stored_name, display_name, mime, size_bytes, size_bytes_on_disk, sha256, created_at, author_id, replaces, upload_expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, values...); err != nil {
+		return nil, err
+	}
+	var pruned []string
+	if takeOver {
+		if pruned, err = takeOverUpload(tx, replaces, uuid); err != nil {
+			return nil, err
+		}
+	}
+	return pruned, tx.Commit()
+}
+
+func generateFileUUID(db *sql.DB) string {
 	for {
 		// Generate token
-		uuid = generateRawToken()
+		uuid := generateRawToken()
 
 		// Check if token already exists
 		var uuidExists bool
 		db.QueryRow("SELECT EXISTS(SELECT 1 FROM files WHERE uuid=?)", uuid).Scan(&uuidExists)
-		if uuidExists {
-			continue
+		if !uuidExists {
+			return uuid
 		}
+	}
+}
 
-		// Continue with registration if token is valid
-		break
+// uploadStatus returns how far the upload uuid got, so clients can resume
+// it, and where it is stored.
+func uploadStatus(db *sql.DB, uuid string) (UploadStatus, string, error) {
+	status := UploadStatus{UploadID: uuid}
+	var storedName string
+	if err := db.QueryRow(`SELECT stored_name, size_bytes, size_bytes_on_disk, upload_expires_at FROM files WHERE uuid = ?`, uuid).Scan(&storedName, &status.SizeBytes, &status.Offset, &status.ExpiresAt); err != nil {
+		if err == sql.ErrNoRows {
+			return status, "", errUploadNotFound
+		}
+		return status, "", err
 	}
 
-	// Create empty temp file
-	tmpPath := filepath.Join(StorageRoot, uuid+".part")
-	f, err := os.Create(tmpPath)
-	if err != nil {
-		log.Printf("Create tmp failed: %s", err.Error())
-		return "", err
+	switch {
+	case !isUpload(storedName):
+		status.State = UploadComplete
+	case status.ExpiresAt != nil && status.ExpiresAt.Before(time.Now()):
+		status.State = UploadExpired
+	case status.Offset == status.SizeBytes:
+		status.State = UploadUploaded
+	default:
+		status.State = UploadUploading
 	}
-	f.Close()
+	return status, storedName, nil
+}
 
-	// Register file
-	if _, err := db.Exec(`INSERT INTO files (uuid, owner_id, folder_id, stored_name, display_name, mime, size_bytes, size_bytes_on_disk, sha256, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		uuid, userId, folderId, tmpPath, upload.Filename, upload.Mime, upload.Size_bytes, 0, strings.ToLower(upload.Sha256), time.Now().UTC()); err != nil {
-		log.Printf("Registration of file failed: %s", err.Error())
-		return "", err
+// uploadsBusy holds the uploads a chunk is written to right now
+var uploadsBusy = struct {
+	sync.Mutex
+	uuids map[string]bool
+}{uuids: make(map[string]bool)}
+
+// claimUpload reports whether no other chunk is written to the upload, the
+// caller has to releaseUpload it then.
+func claimUpload(uuid string) bool {
+	uploadsBusy.Lock()
+	defer uploadsBusy.Unlock()
+	if uploadsBusy.uuids[uuid] {
+		return false
 	}
+	uploadsBusy.uuids[uuid] = true
+	return true
+}
 
-	// Return uuid
-	return uuid, nil
+func releaseUpload(uuid string) {
+	uploadsBusy.Lock()
+	defer uploadsBusy.Unlock()
+	delete(uploadsBusy.uuids, uuid)
 }
 
-func uploadChunk(db *sql.DB, uuid, offsetStr string, bytes io.ReadCloser) error {
-	// Check size
-	var expected, onDisk int64
-	db.QueryRow(`SELECT size_bytes, size_bytes_on_disk FROM files WHERE uuid = ?`, uuid).Scan(&expected, &onDisk)
-	if expected == onDisk {
+// uploadChunk writes a chunk at the end of the upload and returns the new
+// offset. Chunks that leave a gap or overlap what was written are refused
+// with the offset to resume at.
+func uploadChunk(db *sql.DB, uuid, offsetStr string, bytes io.Reader) (int64, error) {
+	offset, errOffset := strconv.ParseInt(offsetStr, 10, 64)
+	if errOffset != nil || offset < 0 {
+		return 0, invalidRequest("invalid offset")
+	}
+
+	// One chunk at a time, a chunk sent while another is written overlaps it
+	claimed := claimUpload(uuid)
+	if claimed {
+		defer releaseUpload(uuid)
+	}
+	status, storedName, err := uploadStatus(db, uuid)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case status.State == UploadComplete || status.State == UploadUploaded:
 		log.Println("File was uploaded completely")
-		return errors.New("file was uploaded completely")
+		return 0, errUploadComplete
+	case status.State == UploadExpired:
+		return 0, errUploadExpired
+	case !claimed || offset != status.Offset:
+		return 0, errUploadOffset.withDetails(map[string]any{"offset": status.Offset})
 	}
 
-	offset, _ := strconv.ParseInt(offsetStr, 10, 64)
-	tmpPath := filepath.Join(StorageRoot, uuid+".part")
+	// Write body at offset, one byte more than fits tells the chunk is too large
+	written, err := Store.Append(storedName, offset, io.LimitReader(bytes, status.SizeBytes-offset+1))
+	if err != nil {
+		log.Printf("write failed: %s", err.Error())
+		return 0, err
+	}
+	if offset+written > status.SizeBytes {
+		if _, err := Store.Append(storedName, offset, strings.NewReader("")); err != nil {
+			log.Printf("Couldnt cut off chunk that is too large: %s", err.Error())
+			return 0, err
+		}
+		return 0, errUploadTooLarge.withDetails(map[string]any{"size_bytes": status.SizeBytes})
+	}
 
-	// Open file
-	f, err := os.OpenFile(tmpPath, os.O_WRONLY, 0644)
+	// Update db, every chunk keeps the upload from expiring for a while
+	newSize := offset + written
+	if _, err := db.Exec(`UPDATE files SET size_bytes_on_disk = ?, upload_expires_at = ? WHERE uuid = ?`, newSize, time.Now().UTC().Add(Conf.UploadTTL), uuid); err != nil {
+		log.Printf("db update failed: %s", err.Error())
+		return 0, err
+	}
+
+	return newSize, nil
+}
+
+// purgeExpiredUploads removes unfinished uploads past their expiry and
+// releases their quota. Uploads a chunk is written to are left for the next
+// run.
+func purgeExpiredUploads(db *sql.DB) error {
+	uuids, err := queryStrings(db, `SELECT uuid FROM files WHERE upload_expires_at < ? AND stored_name LIKE '%.part'`, time.Now().UTC())
 	if err != nil {
-		log.Printf("open tmp failed: %s", err.Error())
 		return err
 	}
-	defer f.Close()
 
-	// Seek to offset then write
-	if _, err := f.Seek(offset, io.SeekStart); err != nil {
-		log.Printf("seek failed: %s", err.Error())
-		return err
+	purged := 0
+	for _, uuid := range uuids {
+		if !claimUpload(uuid) {
+			continue
+		}
+		err := purgeUpload(db, uuid)
+		releaseUpload(uuid)
+		if err != nil {
+			return err
+		}
+		purged++
+	}
+	if purged > 0 {
+		log.Printf("Purged %d expired uploads", purged)
 	}
+	return nil
+}
 
-	// Copy body
-	written, err := io.Copy(f, bytes)
+func purgeUpload(db *sql.DB, uuid string) error {
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("write failed: %s", err.Error())
 		return err
 	}
-	if err := f.Sync(); err != nil {
-		log.Printf("sync failed: %s", err.Error())
+	defer tx.Rollback()
+
+	var ownerId int
+	var storedName string
+	var size int64
+	if err := tx.QueryRow(`SELECT owner_id, stored_name, size_bytes FROM files WHERE uuid = ?`, uuid).Scan(&ownerId, &storedName, &size); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM files WHERE uuid = ?`, uuid); err != nil {
 		return err
 	}
-
-	// Update db
-	newSize := offset + written
-	if _, err := db.Exec(`UPDATE files SET size_bytes_on_disk = ? WHERE uuid = ?`, newSize, uuid); err != nil {
-		log.Printf("db update failed: %s", err.Error())
+	if err := releaseQuota(tx, ownerId, size); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
 		return err
 	}
 
+	releaseStoredFiles(db, []string{storedName})
 	return nil
 }
 
-func finishUpload(db *sql.DB, uuid string, userId int) error {
-	// Check size
-	var expected, onDisk int64
-	db.QueryRow(`SELECT size_bytes, size_bytes_on_disk FROM files WHERE uuid=?`, uuid).Scan(&expected, &onDisk)
-	if expected != onDisk {
+// finishUpload checks the upload against its sha256 and stores it. The
+// quota reserved at the start is kept by the file, a mismatching upload is
+// purged, uploads that fail otherwise can be finished again until they
+// expire.
+func finishUpload(db *sql.DB, uuid string) error {
+	// A chunk is still written or the upload is finished or purged already
+	if !claimUpload(uuid) {
+		return errUploadIncomplete
+	}
+	defer releaseUpload(uuid)
+
+	// Check size, uploads are only finished once
+	status, storedName, err := uploadStatus(db, uuid)
+	if err != nil {
+		return err
+	}
+	onDisk := status.Offset
+	switch status.State {
+	case UploadComplete:
+		log.Println("File was uploaded completely")
+		return errUploadComplete
+	case UploadExpired:
+		return errUploadExpired
+	case UploadUploading:
 		log.Println("File wasnt uploaded completely")
-		return errors.New("file wasnt uploaded completely")
+		return errUploadIncomplete
 	}
 
 	// Get hash
 	var sha256 string
 	if err := db.QueryRow(`SELECT sha256 FROM files WHERE uuid=?`, uuid).Scan(&sha256); err != nil {
 		log.Println("Couldnt get hash of uploaded file: "+err.Error(), http.StatusInternalServerError)
-		releaseQuota(db, userId, onDisk)
 		return err
 	}
 
 	// Check hash
-	tmpPath := filepath.Join(StorageRoot, uuid+".part")
-	finalPath := filepath.Join(StorageRoot, uuid)
-	if fileSha, err := calculateFileSha256(tmpPath); sha256 != fileSha || err != nil {
+	if fileSha, err := hashBlob(Store, storedName); sha256 != fileSha || err != nil {
 		if err != nil {
 			log.Println("error geting hash of a file: "+err.Error(), http.StatusInternalServerError)
 			return err
 		} else {
 			log.Println("hashes of files do not match", http.StatusForbidden)
-			releaseQuota(db, userId, onDisk)
-			return err
+			if err := purgeUpload(db, uuid); err != nil {
+				log.Printf("Couldnt purge upload %s: %s", uuid, err.Error())
+				return err
+			}
+			return errChecksumMismatch
 		}
 	}
 
-	// Update path
-	if _, err := db.Exec(`UPDATE files SET stored_name = ? WHERE uuid = ?`, finalPath, uuid); err != nil {
-		log.Println("db update failed: "+err.Error(), http.StatusInternalServerError)
-		releaseQuota(db, userId, onDisk)
+	// Store content, content that is stored already is shared
+	if err := storeBlob(db, uuid, storedName, sha256, onDisk); err != nil {
+		log.Println("storing blob failed: "+err.Error(), http.StatusInternalServerError)
 		return err
 	}
 
-	// Move temp file to root folder
-	if err := os.Rename(tmpPath, finalPath); err != nil {
-		log.Println("rename failed: "+err.Error(), http.StatusInternalServerError)
-		releaseQuota(db, userId, onDisk)
-		return err
+	// A new version takes the place of the file it replaces
+	var replaces sql.NullString
+	db.QueryRow(`SELECT replaces FROM files WHERE uuid=?`, uuid).Scan(&replaces)
+	if replaces.Valid {
+		return addVersion(db, replaces.String, uuid)
 	}
 
 	return nil
 }
 
-func getFileByUUID(db *sql.DB, userId int, uuid string) (File *os.File, Mime string, SafeName string, ModTime time.Time, Err error) {
+func getFileByUUID(db *sql.DB, userId int, uuid string) (StoredName string, Size int64, Mime string, SafeName string, ModTime time.Time, Err error) {
 	// Get file metadata
 	var ownerId int
 	var storedName, displayName, mime, sha256 string
@@ -169,72 +362,57 @@ func getFileByUUID(db *sql.DB, userId int, uuid string) (File *os.File, Mime str
 	if err := row.Scan(&ownerId, &storedName, &displayName, &mime, &sizeBytes, &sha256); err != nil {
 		if err == sql.ErrNoRows {
 			log.Printf("No such file")
-			return nil, "", "", time.Time{}, err
+			return "", 0, "", "", time.Time{}, errFileNotFound
 		}
 		log.Printf("DB error: "+err.Error(), http.StatusInternalServerError)
-		return nil, "", "", time.Time{}, err
+		return "", 0, "", "", time.Time{}, err
 	}
 
 	// Check permission
 	if ownerId != userId {
-		return nil, "", "", time.Time{}, errors.New("Forbidden")
+		return "", 0, "", "", time.Time{}, errFileNotFound
 	}
 
-	// Construct full path and check file exists
-	fi, err := os.Stat(storedName)
+	// Check file exists
+	info, err := Store.Stat(storedName)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			log.Printf("No such file: %s", storedName)
-			return nil, "", "", time.Time{}, err
+			return "", 0, "", "", time.Time{}, err
 		}
 		log.Printf("stat error: "+err.Error(), http.StatusInternalServerError)
-		return nil, "", "", time.Time{}, err
+		return "", 0, "", "", time.Time{}, err
 	}
 
 	// Suggest filename
 	safeName := filepath.Base(displayName)
 
-	// Serve file
-	f, err := os.Open(storedName)
-	if err != nil {
-		log.Printf("Open error: %s", err.Error())
-		return nil, "", "", time.Time{}, err
-	}
-
-	return f, mime, safeName, fi.ModTime(), nil
+	return storedName, info.Size, mime, safeName, info.ModTime, nil
 }
 
-func deleteFile(db *sql.DB, userId int, uuid string) error {
-	// Get file size and path
-	var fileSize int64
-	var storedName string
-	if err := db.QueryRow(`SELECT size_bytes_on_disk, stored_name FROM files WHERE uuid=?`, uuid).Scan(&fileSize, &storedName); err != nil {
-		return err
-	}
-
-	// Remove file from db
-	if _, err := db.Exec(`DELETE FROM files WHERE uuid=?`, uuid, userId); err != nil {
+func renameFile(db *sql.DB, uuid, name string) error {
+	if err := checkName(name); err != nil {
 		return err
 	}
 
-	// Update users space usage
-	if err := releaseQuota(db, userId, fileSize); err != nil {
+	// Get folder of the file
+	var ownerId, folderId int
+	err := db.QueryRow(`SELECT owner_id, folder_id FROM files WHERE uuid=?`, uuid).Scan(&ownerId, &folderId)
+	if err == sql.ErrNoRows {
+		return errFileNotFound
+	} else if err != nil {
 		return err
 	}
 
-	// Remove file from disk
-	if err := os.Remove(storedName); err != nil {
+	// Files have no unique names in the db, check the folder
+	if _, _, err := resolveName(db, ownerId, folderId, TrashFile, name, ConflictFail, uuid, true); err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func renameFile(db *sql.DB, uuid, name string) error {
 	// Update filename
-	if _, err := db.Exec(`UPDATE files SET display_name=? WHERE uuid=?`, name, uuid); err != nil {
-		return err
+	_, err = db.Exec(`UPDATE files SET display_name=? WHERE uuid=?`, name, uuid)
+	if isUniqueViolation(err) {
+		return errNameConflict.withDetails(map[string]any{"name": name})
 	}
-
-	return nil
+	return err
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setupUploads opens a test db and a local store and returns a user with
+// quota for uploads.
+func setupUploads(t *testing.T) (*sql.DB, int) {
+	t.Helper()
+	db := openTestDB(t)
+	prevConf, prevStore := Conf, Store
+	t.Cleanup(func() { Conf, Store = prevConf, prevStore })
+	Conf = defaultConfig()
+	Conf.StorageRoot = t.TempDir()
+	Store = &LocalStore{root: Conf.StorageRoot}
+
+	userId, err := insertUser(db, "uploader", "x", "user", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, int(userId)
+}
+
+func usedBytes(t *testing.T, db *sql.DB, userId int) int64 {
+	t.Helper()
+	var used int64
+	if err := db.QueryRow(`SELECT used_bytes FROM users WHERE id = ?`, userId).Scan(&used); err != nil {
+		t.Fatal(err)
+	}
+	return used
+}
+
+func TestFinishUploadChecksumMismatch(t *testing.T) {
+	db, userId := setupUploads(t)
+
+	// A file the quota of the failed upload must not be taken from
+	keep := "kept content"
+	keepSum := sha256.Sum256([]byte(keep))
+	keepId, _, err := startUpload(db, userId, UploadReq{Path: "~", Filename: "keep.txt", Size_bytes: int64(len(keep)), Sha256: hex.EncodeToString(keepSum[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploadChunk(db, keepId, "0", strings.NewReader(keep)); err != nil {
+		t.Fatal(err)
+	}
+	if err := finishUpload(db, keepId); err != nil {
+		t.Fatal(err)
+	}
+
+	// An upload that doesnt match its sha256
+	content := "announced content"
+	sum := sha256.Sum256([]byte(content))
+	uuid, _, err := startUpload(db, userId, UploadReq{Path: "~", Filename: "bad.txt", Size_bytes: int64(len(content)), Sha256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploadChunk(db, uuid, "0", strings.NewReader(strings.ToUpper(content))); err != nil {
+		t.Fatal(err)
+	}
+	if got := usedBytes(t, db, userId); got != int64(len(keep)+len(content)) {
+		t.Fatalf("used %d bytes before finishing, want %d", got, len(keep)+len(content))
+	}
+
+	if err := finishUpload(db, uuid); err != errChecksumMismatch {
+		t.Fatalf("finish: got %v, want errChecksumMismatch", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := finishUpload(db, uuid); err != errUploadNotFound {
+			t.Errorf("finish again: got %v, want errUploadNotFound", err)
+		}
+	}
+	if err := purgeExpiredUploads(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// The quota of the upload is released once
+	if got := usedBytes(t, db, userId); got != int64(len(keep)) {
+		t.Errorf("used %d bytes after finishing, want %d", got, len(keep))
+	}
+	if _, err := Store.Stat(uuid + ".part"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("upload left in the store: %v", err)
+	}
+}
+
+func TestUploadChunkTooLarge(t *testing.T) {
+	db, userId := setupUploads(t)
+
+	uuid, _, err := startUpload(db, userId, UploadReq{Path: "~", Filename: "a.txt", Size_bytes: 10, Sha256: strings.Repeat("0", 64)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploadChunk(db, uuid, "0", strings.NewReader("12345")); err != nil {
+		t.Fatal(err)
+	}
+	var apiErr *APIError
+	if _, err := uploadChunk(db, uuid, "5", strings.NewReader("6789012")); !errors.As(err, &apiErr) || apiErr.Code != errUploadTooLarge.Code {
+		t.Fatalf("too large chunk: got %v", err)
+	}
+
+	// The chunk is cut off, the upload resumes where it was
+	info, err := Store.Stat(uuid + ".part")
+	if err != nil || info.Size != 5 {
+		t.Fatalf("upload after a too large chunk: %+v, %v", info, err)
+	}
+	offset, err := uploadChunk(db, uuid, "5", strings.NewReader("67890"))
+	if err != nil || offset != 10 {
+		t.Errorf("resume: got offset %d, %v", offset, err)
+	}
+
+	// Errors of cutting it off are returned
+	if _, err := db.Exec(`UPDATE files SET size_bytes_on_disk = 0 WHERE uuid = ?`, uuid); err != nil {
+		t.Fatal(err)
+	}
+	Store = &failingTruncateStore{Store}
+	if _, err := uploadChunk(db, uuid, "0", strings.NewReader(strings.Repeat("x", 11))); err != errTruncateFailed {
+		t.Errorf("failed cut off: got %v, want errTruncateFailed", err)
+	}
+}
+
+var errTruncateFailed = errors.New("truncate failed")
+
+// failingTruncateStore fails appends without content.
+type failingTruncateStore struct {
+	BlobStore
+}
+
+func (s *failingTruncateStore) Append(name string, offset int64, r io.Reader) (int64, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(content) == 0 {
+		return 0, errTruncateFailed
+	}
+	return s.BlobStore.Append(name, offset, strings.NewReader(string(content)))
+}
+
+// failingFinalizeStore fails to finalize uploads.
+type failingFinalizeStore struct {
+	BlobStore
+}
+
+func (s *failingFinalizeStore) Finalize(upload, name string) error {
+	return errors.New("finalize failed")
+}
+
+func TestFinishUploadStoreFailure(t *testing.T) {
+	db, userId := setupUploads(t)
+
+	content := "some content"
+	sum := sha256.Sum256([]byte(content))
+	uuid, _, err := startUpload(db, userId, UploadReq{Path: "~", Filename: "a.txt", Size_bytes: int64(len(content)), Sha256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploadChunk(db, uuid, "0", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upload keeps its quota and can be finished again
+	Store = &failingFinalizeStore{Store}
+	for i := 0; i < 3; i++ {
+		if err := finishUpload(db, uuid); err == nil {
+			t.Fatal("finish succeeded")
+		}
+	}
+	if got := usedBytes(t, db, userId); got != int64(len(content)) {
+		t.Errorf("used %d bytes after failed finishes, want %d", got, len(content))
+	}
+
+	// Until it expires and is purged
+	if _, err := db.Exec(`UPDATE files SET upload_expires_at = '2000-01-01 00:00:00' WHERE uuid = ?`, uuid); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := purgeExpiredUploads(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := usedBytes(t, db, userId); got != 0 {
+		t.Errorf("used %d bytes after purging, want 0", got)
+	}
+}
+
+func TestRenames(t *testing.T) {
+	db, userId := setupUploads(t)
+
+	var ids []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		uuid, _, err := startUpload(db, userId, UploadReq{Path: "~", Filename: name, Size_bytes: 1, Sha256: strings.Repeat("0", 64)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, uuid)
+	}
+	for _, path := range []string{"~/docs", "~/notes"} {
+		if err := createFolder(db, path, userId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var apiErr *APIError
+	for _, name := range []string{"", ".", "..", "x/y"} {
+		if err := renameFile(db, ids[0], name); !errors.As(err, &apiErr) || apiErr.Code != errInvalidName.Code {
+			t.Errorf("rename file to %q: got %v", name, err)
+		}
+		if err := renameFolder(db, "~/docs", name, userId); !errors.As(err, &apiErr) || apiErr.Code != errInvalidName.Code {
+			t.Errorf("rename folder to %q: got %v", name, err)
+		}
+	}
+
+	// Taken names are a conflict
+	if err := renameFile(db, ids[0], "b.txt"); !errors.As(err, &apiErr) || apiErr.Status != 409 {
+		t.Errorf("rename file to a taken name: got %v", err)
+	}
+	if err := renameFolder(db, "~/docs", "notes", userId); !errors.As(err, &apiErr) || apiErr.Status != 409 {
+		t.Errorf("rename folder to a taken name: got %v", err)
+	}
+
+	// Free names and the own name are fine
+	if err := renameFile(db, ids[0], "a.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := renameFile(db, ids[0], "c.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := renameFolder(db, "~/docs", "papers", userId); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStartUploadVersionFailure(t *testing.T) {
+	db, userId := setupUploads(t)
+	content := "versioned content"
+	fileUUID := uploadFile(t, db, userId, "~", "a.txt", content)
+
+	// A new version with stored content is complete at once, archiving the
+	// current version fails
+	if _, err := db.Exec(`CREATE TRIGGER fail_archive BEFORE INSERT ON file_versions BEGIN SELECT RAISE(ABORT, 'archive failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	if _, _, err := startUpload(db, userId, UploadReq{FileUUID: fileUUID, Size_bytes: int64(len(content)), Sha256: hex.EncodeToString(sum[:])}); err == nil {
+		t.Fatal("start succeeded")
+	}
+
+	// Neither quota nor a row of the upload are left behind
+	if got := usedBytes(t, db, userId); got != int64(len(content)) {
+		t.Errorf("used %d bytes, want %d", got, len(content))
+	}
+	var files int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM files`).Scan(&files); err != nil || files != 1 {
+		t.Errorf("%d files, %v", files, err)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	_, userId := setupUploads(t)
+	uuid, _, err := startUpload(DB, userId, UploadReq{Path: "~", Filename: "a.txt", Size_bytes: 10, Sha256: strings.Repeat("0", 64)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := newRouter()
+	rt.Handle("GET", "/api/storage/uploads/{uuid}", handleUploadStatus)
+	rt.Handle("PUT", "/api/storage/uploads/{uuid}", handleUploadChunk)
+	handler := rt.Handler()
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	// A partial chunk
+	if rec := serve("PUT", "/api/storage/uploads/"+uuid+"?offset=0", "12345"); rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("chunk: %d, offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+
+	// A chunk sent again is refused with the offset to resume at
+	rec := serve("PUT", "/api/storage/uploads/"+uuid+"?offset=0", "12345")
+	var apiErr APIError
+	if err := json.NewDecoder(rec.Body).Decode(&apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusConflict || apiErr.Code != errUploadOffset.Code || apiErr.Details["offset"] != float64(5) {
+		t.Errorf("stale chunk: %d %+v", rec.Code, apiErr)
+	}
+
+	// Status reports the stored offset, HEAD only in its headers
+	rec = serve("GET", "/api/storage/uploads/"+uuid, "")
+	var status UploadStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || status.Offset != 5 || status.SizeBytes != 10 || status.State != UploadUploading || rec.Header().Get("Upload-Offset") != "5" {
+		t.Errorf("status: %d %+v, offset header %q", rec.Code, status, rec.Header().Get("Upload-Offset"))
+	}
+	rec = serve("HEAD", "/api/storage/uploads/"+uuid, "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "5" || rec.Header().Get("Upload-Length") != "10" {
+		t.Errorf("head: %d, offset %q, length %q", rec.Code, rec.Header().Get("Upload-Offset"), rec.Header().Get("Upload-Length"))
+	}
+
+	// And the upload resumes there
+	if rec := serve("PUT", "/api/storage/uploads/"+uuid+"?offset=5", "67890"); rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "10" {
+		t.Errorf("resume: %d, offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+}
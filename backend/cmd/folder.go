@@ -2,7 +2,6 @@ package main
 
 import (
 	"database/sql"
-	"errors"
 	"log"
 	"strings"
 )
@@ -10,7 +9,7 @@ import (
 func getFolderIdFromPath(db *sql.DB, path string, ownerId int) (int, error) {
 	// Check the path
 	if path == "" || path[0] != '~' {
-		return -1, errors.New("invalid path")
+		return -1, errFolderNotFound
 	}
 
 	// Split the path into folders
@@ -18,7 +17,7 @@ func getFolderIdFromPath(db *sql.DB, path string, ownerId int) (int, error) {
 
 	// Get users root folder
 	var rootFolderId int
-	if err := db.QueryRow(`SELECT id FROM folders WHERE owner_id=? AND name=?`, ownerId, "~").Scan(&rootFolderId); err != nil {
+	if err := db.QueryRow(`SELECT id FROM folders WHERE owner_id=? AND name=? AND parent_id IS NULL AND deleted_at IS NULL`, ownerId, "~").Scan(&rootFolderId); err != nil {
 		return -1, err
 	}
 
@@ -28,18 +27,59 @@ func getFolderIdFromPath(db *sql.DB, path string, ownerId int) (int, error) {
 	for i := 1; i < len(folders); i++ {
 		folderName = folders[i]
 		if err := db.QueryRow(`SELECT id FROM folders WHERE owner_id=? AND name=? AND parent_id=?`, ownerId, folderName, folderId).Scan(&folderId); err != nil {
-			return -1, errors.New("invalid path")
+			return -1, errFolderNotFound
 		}
 	}
 
 	return folderId, nil
 }
 
+// getFolderPathFromId returns the path of a folder, errFolderNotFound if it
+// or one of its parents is in the trash.
+func getFolderPathFromId(db dbRowExecer, folderId int) (string, error) {
+	// Walk up to the root folder
+	names := make([]string, 0)
+	for {
+		var name string
+		var parentId sql.NullInt64
+		var deletedAt sql.NullTime
+		if err := db.QueryRow(`SELECT name, parent_id, deleted_at FROM folders WHERE id=?`, folderId).Scan(&name, &parentId, &deletedAt); err != nil {
+			return "", err
+		}
+		if deletedAt.Valid {
+			return "", errFolderNotFound
+		}
+		names = append([]string{name}, names...)
+		if !parentId.Valid {
+			break
+		}
+		folderId = int(parentId.Int64)
+	}
+
+	return strings.Join(names, "/"), nil
+}
+
+func getFilePath(db dbRowExecer, uuid string) (string, error) {
+	// Get the folder the file is in
+	var folderId int
+	if err := db.QueryRow(`SELECT folder_id FROM files WHERE uuid=?`, uuid).Scan(&folderId); err != nil {
+		return "", err
+	}
+
+	return getFolderPathFromId(db, folderId)
+}
+
 func createFolder(db *sql.DB, folderPath string, ownerId int) error {
 	// Get paths
 	lastSlashIndex := strings.LastIndex(folderPath, "/")
+	if lastSlashIndex < 0 {
+		return errInvalidName.withDetails(map[string]any{"name": folderPath})
+	}
 	folderName := folderPath[lastSlashIndex+1:]
-	parentFolderPath := folderPath[:lastSlashIndex-1]
+	parentFolderPath := folderPath[:lastSlashIndex]
+	if err := checkName(folderName); err != nil {
+		return err
+	}
 
 	// Get parent folder id
 	parentFolderId, errFolderId := getFolderIdFromPath(db, parentFolderPath, ownerId)
@@ -48,77 +88,30 @@ func createFolder(db *sql.DB, folderPath string, ownerId int) error {
 	}
 
 	// Create folder in db
-	_, errCreateFolder := db.Exec(`INSERT INTO folders (owner_id, name, parent_id)`, ownerId, folderName, parentFolderId)
+	_, errCreateFolder := db.Exec(`INSERT INTO folders (owner_id, name, parent_id) VALUES (?, ?, ?)`, ownerId, folderName, parentFolderId)
+	if isUniqueViolation(errCreateFolder) {
+		return errNameConflict.withDetails(map[string]any{"name": folderName})
+	}
 	return errCreateFolder
 }
 
 func renameFolder(db *sql.DB, folderPath, name string, ownerId int) error {
-	// Get folder id
-	folderId, errFolderId := getFolderIdFromPath(db, folderPath, ownerId)
-	if errFolderId != nil {
-		return errFolderId
+	if err := checkName(name); err != nil {
+		return err
 	}
 
-	// Rename folder in db
-	_, errDeleteFolder := db.Exec(`UPDATE folders SET name=? WHERE id=?`, name, folderId)
-	return errDeleteFolder
-}
-
-func deleteFolder(db *sql.DB, folderPath string, ownerId int) error {
 	// Get folder id
 	folderId, errFolderId := getFolderIdFromPath(db, folderPath, ownerId)
 	if errFolderId != nil {
 		return errFolderId
 	}
 
-	// Delete folders and contens recursicely (rm -r)
-	errDeleteFolderContents := deleteFolderContents(db, folderId, ownerId)
-	return errDeleteFolderContents
-}
-
-func deleteFolderContents(db *sql.DB, folderId, ownerId int) error {
-	// Get files in the folder
-	fileRows, errFilesQuery := db.Query(`SELECT uuid FROM files WHERE folder_id=?`, folderId)
-	if errFilesQuery != nil {
-		return errFilesQuery
-	}
-	defer fileRows.Close()
-
-	// Delete files in the folder
-	for fileRows.Next() {
-		var uuid string
-		if err := fileRows.Scan(&uuid); err != nil {
-			return err
-		}
-		if err := deleteFile(db, ownerId, uuid); err != nil {
-			return err
-		}
-	}
-
-	// Get child folders
-	folderRows, errFolderQuery := db.Query(`SELECT folder_id FROM folders WHERE parent_id=?`, folderId)
-	if errFolderQuery != nil {
-		return errFolderQuery
-	}
-	defer folderRows.Close()
-
-	// Remove folders recursively
-	for folderRows.Next() {
-		var folderId int
-		if err := folderRows.Scan(&folderId); err != nil {
-			return err
-		}
-		if err := deleteFolderContents(db, folderId, ownerId); err != nil {
-			return err
-		}
-	}
-
-	// Remove the folder
-	if _, err := db.Exec(`DELETE FROM folders WHERE id=?`, folderId); err != nil {
-		return err
+	// Rename folder in db
+	_, errRenameFolder := db.Exec(`UPDATE folders SET name=? WHERE id=?`, name, folderId)
+	if isUniqueViolation(errRenameFolder) {
+		return errNameConflict.withDetails(map[string]any{"name": name})
 	}
-
-	return nil
+	return errRenameFolder
 }
 
 func listFolderContents(db *sql.DB, folderPath string, ownerId int) (FolderContents, error) {
@@ -132,7 +125,7 @@ func listFolderContents(db *sql.DB, folderPath string, ownerId int) (FolderConte
 	}
 
 	// Get files in the folder
-	fileRows, errFileQuery := db.Query(`SELECT uuid, display_name, mime, size_bytes, sha256, created_at FROM files WHERE owner_id = ? AND folder_id = ? AND deleted_at IS NULL`, ownerId, folderId)
+	fileRows, errFileQuery := db.Query(`SELECT uuid, display_name, mime, size_bytes, sha256, created_at FROM files WHERE owner_id = ? AND folder_id = ? AND deleted_at IS NULL AND replaces IS NULL`, ownerId, folderId)
 
 	if errFileQuery != nil && errFileQuery != sql.ErrNoRows {
 		log.Printf("Couldnt get file rows: %s", errFileQuery.Error())
@@ -171,13 +164,13 @@ func listFolderContents(db *sql.DB, folderPath string, ownerId int) (FolderConte
 		log.Printf("Couldnt get folder rows: %s", errFolderQuery.Error())
 		return contents, errFolderQuery
 	}
-	defer fileRows.Close()
+	defer folderRows.Close()
 
 	// Turn sql rows into structs
 	folders := make([]FolderWrapper, 0)
 	for folderRows.Next() {
 		var f FolderWrapper
-		if err := fileRows.Scan(&f.Name, &f.CreatedAt); err != nil {
+		if err := folderRows.Scan(&f.Name, &f.CreatedAt); err != nil {
 			log.Printf("Couldnt scan folder rows: %s", err.Error())
 			return contents, err
 		}
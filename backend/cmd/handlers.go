@@ -6,416 +6,1114 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"strings"
+	"slices"
+	"strconv"
+	"time"
 )
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
+func handleAuth(w http.ResponseWriter, r *http.Request) {
+	// Get login data
+	var login LoginReq
+	if err := decodeJSON(w, r, &login); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Slow down guessing, the attempt counts as failed until it succeeds
+	ipKey, userKey := ipThrottleKey(clientIP(r)), userThrottleKey(login.Username)
+	reservedAt, wait := reserveAttempt(DB, ipKey, userKey)
+	if wait > 0 {
+		recordAudit(DB, 0, login.Username, "user.login.locked", "", clientIP(r), AuditFailure)
+		writeTooManyAttempts(w, wait)
+		return
+	}
+
+	// Authenticate login
+	userId, errLogin := getUserIdByLogin(DB, login.Username, login.Password)
+	if errLogin != nil {
+		recordAudit(DB, 0, login.Username, "user.login", "", clientIP(r), AuditFailure)
+		writeError(w, errInvalidLogin)
+		return
+	}
 
-		// Preflight request
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
+	// Failures of the ip stay counted, logins to other accounts dont lift them
+	resetThrottle(DB, userKey)
+	releaseAttempt(DB, reservedAt, ipKey)
+
+	// Users with 2fa get a token for the second step instead of a session
+	mfaEnabled, errMFA := isTOTPEnabled(DB, userId)
+	if errMFA != nil {
+		writeError(w, errMFA)
+		return
+	}
+	if mfaEnabled {
+		mfaToken, err := createMFAToken(DB, userId)
+		if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		next.ServeHTTP(w, r)
-	})
+		auditRequest(r, userId, "user.login.password", "", AuditSuccess)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MFAChallengeWrapper{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			ExpiresAt:   time.Now().Add(MFATokenValidMinutes * time.Minute).UTC().String(),
+		})
+		return
+	}
+
+	// Create auth token
+	resp, errToken := createAuthToken(DB, userId, r.UserAgent(), clientIP(r))
+	if errToken != nil {
+		writeError(w, errToken)
+		return
+	}
+	auditRequest(r, userId, "user.login", "", AuditSuccess)
+
+	// Send auth token
+	w.Header().Add("Authorization", resp.Token)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
-func handleAuth(w http.ResponseWriter, r *http.Request) {
-	// Clean db from expired or invalid tokens
-	if err := runSqlFromFile(DB, "./migrations/cleanTokens.sql"); err != nil {
-		log.Printf("Couldnt clear tokens: %s", err.Error())
+func handleAuthSecondFactor(w http.ResponseWriter, r *http.Request) {
+	// Get second step data
+	var mfa MFAReq
+	if err := decodeJSON(w, r, &mfa); err != nil {
+		writeError(w, err)
+		return
 	}
 
-	// Get login data
-	var login LoginReq
-	if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	// Find the user of the login
+	ipKey := ipThrottleKey(clientIP(r))
+	userId, errToken := getMFATokenUser(DB, mfa.MFAToken)
+	if errToken != nil {
+		recordFailedAttempt(DB, ipKey)
+		writeError(w, errInvalidLogin)
 		return
 	}
 
-	// Authenticate login
-	userId, errLogin := getUserIdByLogin(DB, login.Username, login.Password)
-	if errLogin != nil {
-		http.Error(w, "Invalid login", http.StatusUnauthorized)
+	// Slow down guessing
+	mfaKey := "mfa:" + strconv.Itoa(userId)
+	reservedAt, wait := reserveAttempt(DB, ipKey, mfaKey)
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
+
+	// Check totp or recovery code
+	if _, errMFA := redeemMFAToken(DB, mfa.MFAToken, mfa.Code); errMFA != nil {
+		auditRequest(r, userId, "user.login.2fa", "", AuditFailure)
+		writeError(w, errInvalidLogin)
+		return
+	}
+	resetThrottle(DB, mfaKey)
+	releaseAttempt(DB, reservedAt, ipKey)
+
+	// Create auth token
+	resp, errToken := createAuthToken(DB, userId, r.UserAgent(), clientIP(r))
+	if errToken != nil {
+		writeError(w, errToken)
+		return
+	}
+	auditRequest(r, userId, "user.login.2fa", "", AuditSuccess)
+
+	// Send auth token
+	w.Header().Add("Authorization", resp.Token)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	// Send browser to the identity provider
+	authURL, err := startOIDCLogin(DB, 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	// Provider reported an error
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		writeError(w, &APIError{Status: http.StatusUnauthorized, Code: "oidc_error", Message: "Login failed at the identity provider", Details: map[string]any{"error": errParam}})
+		return
+	}
+
+	// Redeem code
+	userId, err := finishOIDCLogin(DB, r.URL.Query().Get("state"), r.URL.Query().Get("code"))
+	if err != nil {
+		log.Printf("Oidc login failed: %s", err.Error())
+		auditRequest(r, 0, "user.login.oidc", OIDC.Issuer, AuditFailure)
+		if err == errOIDCDisabled || err == errOIDCNotAllowed {
+			writeError(w, err)
+			return
+		}
+		writeError(w, errInvalidLogin)
 		return
 	}
 
 	// Create auth token
-	token, tokenExpiryDate, errToken := createAuthToken(DB, userId)
+	resp, errToken := createAuthToken(DB, userId, r.UserAgent(), clientIP(r))
 	if errToken != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
+		writeError(w, errToken)
 		return
 	}
+	auditRequest(r, userId, "user.login.oidc", OIDC.Issuer, AuditSuccess)
 
 	// Send auth token
-	w.Header().Add("Authorization", token)
+	w.Header().Add("Authorization", resp.Token)
 	w.Header().Set("Content-Type", "application/json")
-	resp := TokenWrapper{
-		Token:     token,
-		ExpiresAt: tokenExpiryDate,
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	// Get refresh token
+	var refresh RefreshReq
+	if err := decodeJSON(w, r, &refresh); err != nil {
+		writeError(w, err)
+		return
 	}
+
+	// Rotate tokens
+	resp, errRefresh := refreshAuthToken(DB, refresh.RefreshToken, r.UserAgent(), clientIP(r))
+	if errRefresh != nil {
+		if errRefresh == sql.ErrNoRows {
+			writeError(w, errInvalidRefresh)
+			return
+		}
+		writeError(w, errRefresh)
+		return
+	}
+
+	// Send new tokens
+	w.Header().Add("Authorization", resp.Token)
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
 func handleRegister(w http.ResponseWriter, r *http.Request) {
 	// Decode registration data
 	var register LoginReq
-	if err := json.NewDecoder(r.Body).Decode(&register); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if err := decodeJSON(w, r, &register); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Slow down guessing of invite tokens
+	ipKey := ipThrottleKey(clientIP(r))
+	reservedAt, wait := reserveAttempt(DB, ipKey)
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
 		return
 	}
 
-	// Verify invite token and create user
-	if err := createUser(DB, r.Header.Get("Authorization"), register.Username, register.Password); err != nil {
+	// Verify invite token and create user, only invalid tokens stay counted
+	err := createUser(DB, r.Header.Get("Authorization"), register.Username, register.Password)
+	recordAudit(DB, 0, register.Username, "invite.redeem", hashToken(r.Header.Get("Authorization")), clientIP(r), auditResult(err))
+	if err != sql.ErrNoRows {
+		releaseAttempt(DB, reservedAt, ipKey)
+	}
+	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "Invalid invite", http.StatusUnauthorized)
+			writeError(w, errInvalidInvite)
 			return
 		}
-		http.Error(w, "Server error", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func handleUser(w http.ResponseWriter, r *http.Request) {
-	// Authenticate user
-	userId, errAuth := authenticateUser(DB, r.Header.Get("Authorization"))
-	if errAuth != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+func handleGetUser(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
+
+	// Get user info from db
+	var userInfo UserInfoWrapper
+	if err := DB.QueryRow(`SELECT username, quota_bytes, used_bytes FROM users WHERE id=?`, userId).Scan(&userInfo.Username, &userInfo.QuotaBytes, &userInfo.UsedBytes); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	switch r.Method {
+	// Convert to JSON and send
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userInfo)
+}
 
-	case http.MethodGet:
-		// Get user info from db
-		var userInfo UserInfoWrapper
-		if err := DB.QueryRow(`SELECT username, quota_bytes, used_bytes FROM users WHERE id=?`, userId).Scan(&userInfo.Username, &userInfo.QuotaBytes, &userInfo.UsedBytes); err != nil {
-			http.Error(w, "Get user info failed", http.StatusInternalServerError)
-			return
-		}
+func handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
 
-		// Convert to JSON and send
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(userInfo)
+	// Decode new data
+	var newLogin LoginReq
+	if err := decodeJSON(w, r, &newLogin); err != nil {
+		writeError(w, err)
+		return
+	}
 
-	case http.MethodPatch:
-		// Decode new data
-		var newLogin LoginReq
-		if err := json.NewDecoder(r.Body).Decode(&newLogin); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
+	// Update user
+	err := updateUser(DB, userId, newLogin.Username, newLogin.Password)
+	auditRequest(r, userId, "user.update", "", auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
 
-		// Update user
-		err := updateUser(DB, userId, newLogin.Username, newLogin.Password)
-		if err != nil {
-			http.Error(w, "Update user failed", http.StatusInternalServerError)
-			return
-		}
+func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
 
-	case http.MethodDelete:
-		// Delete user
-		if err := deleteUser(DB, r.Header.Get("Authorization")); err != nil {
-			http.Error(w, "Delete user failed", http.StatusInternalServerError)
-			return
-		}
+	// Delete user, remember the name for the audit log
+	var username string
+	DB.QueryRow(`SELECT username FROM users WHERE id=?`, userId).Scan(&username)
+	errDelete := deleteUser(DB, userId)
+	recordAudit(DB, userId, username, "user.delete", "", clientIP(r), auditResult(errDelete))
+	if err := errDelete; err != nil {
+		writeError(w, err)
+		return
+	}
+}
 
-		// Delete users files
-		if err := deleteFolder(DB, "~", userId); err != nil {
-			http.Error(w, "Delete users files failed", http.StatusInternalServerError)
-			return
-		}
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
 
-	default:
-		http.Error(w, "Invalid method", http.StatusBadRequest)
+	// Revoke current token
+	err := revokeAuthToken(DB, p.Token)
+	auditRequest(r, p.UserID, "user.logout", "", auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
 }
 
-func handleInvites(w http.ResponseWriter, r *http.Request) {
-	// Authenticate admin token
-	isAdmin, errAuth := authenticateAdmin(DB, r.Header.Get("Authorization"))
-	if errAuth != nil {
-		http.Error(w, "Authenticate admin failed", http.StatusInternalServerError)
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+
+	// Get users sessions
+	sessions, err := listSessions(DB, p.UserID, p.Token)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
-	if !isAdmin {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+	// Send sessions as json array
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+
+	// Revoke every session except the current one
+	err := revokeOtherSessions(DB, p.UserID, p.Token)
+	auditRequest(r, p.UserID, "session.revoke_others", "", auditResult(err))
+	if err != nil {
+		writeError(w, err)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
 
-	switch r.Method {
-	case http.MethodGet:
-		//Query db for tokens
-		inviteTokens := make([]TokenWrapper, 0)
-		rows, errQuery := DB.Query(`SELECT token, expires_at FROM invite_tokens`)
-		if errQuery != nil {
-			http.Error(w, "Query db for invite tokens failed", http.StatusInternalServerError)
+	sessionId := r.PathValue("id")
+
+	// Revoke session
+	err := revokeSession(DB, userId, sessionId)
+	auditRequest(r, userId, "session.revoke", sessionId, auditResult(err))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, errSessionNotFound)
 			return
 		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-		// Process tokens into structs
-		for rows.Next() {
-			var token TokenWrapper
-			if err := rows.Scan(&token.Token, &token.ExpiresAt); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			inviteTokens = append(inviteTokens, token)
-		}
+func handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
 
-		// Senf tokens as json array
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(inviteTokens)
+	// Start enrollment
+	enroll, err := enrollTOTP(DB, userId)
+	auditRequest(r, userId, "2fa.enroll", "", auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-	case http.MethodPost:
-		// Create invite token
-		inviteToken, errCreateInvite := createInviteToken(DB)
-		if errCreateInvite != nil {
-			http.Error(w, "Create invite failed", http.StatusInternalServerError)
-			return
-		}
+	// Send secret and otpauth uri
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enroll)
+}
 
-		// Send invite token
-		w.Header().Set("Content-Type", "application/json")
-		resp := TokenWrapper{
-			Token: inviteToken,
-		}
-		json.NewEncoder(w).Encode(resp)
+func handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
 
-	default:
-		http.Error(w, "Invalid method", http.StatusBadRequest)
+	// Disabling 2fa needs a current code
+	var codeReq TOTPCodeReq
+	if err := decodeJSON(w, r, &codeReq); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := verifySecondFactor(DB, userId, codeReq.Code); err != nil {
+		auditRequest(r, userId, "2fa.disable", "", AuditFailure)
+		writeError(w, errInvalidTOTPCode)
 		return
 	}
 
+	// Disable 2fa
+	err := disableTOTP(DB, userId)
+	auditRequest(r, userId, "2fa.disable", "", auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
-func handleUploads(w http.ResponseWriter, r *http.Request) {
-	// Authenticate auth token
-	userId, errAuth := authenticateUser(DB, r.Header.Get("Authorization"))
-	if errAuth != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+func handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
+
+	// Get code
+	var codeReq TOTPCodeReq
+	if err := decodeJSON(w, r, &codeReq); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	switch r.Method {
-	case http.MethodPost:
-		// Get upload data
-		var upload UploadReq
-		if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
+	// Confirm enrollment
+	codes, err := confirmTOTP(DB, userId, codeReq.Code)
+	auditRequest(r, userId, "2fa.confirm", "", auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-		// Register an upload
-		uuid, errUploadStart := startUpload(DB, userId, upload)
-		if errUploadStart != nil {
-			http.Error(w, "Start upload failed", http.StatusInternalServerError)
-			return
-		}
+	// Send recovery codes, this is the only time they are shown
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesWrapper{RecoveryCodes: codes})
+}
 
-		// Respond with uuid
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"upload_id":"` + uuid + `"}`))
-	default:
-		http.Error(w, "Invalid method", http.StatusBadRequest)
+func handleOIDCLink(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
+
+	// Start a login that links the identity to this user
+	authURL, err := startOIDCLogin(DB, userId)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
+
+	// Send url the browser has to open
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": authURL})
 }
 
-func handleUploadProcess(w http.ResponseWriter, r *http.Request) {
-	// Authenticate auth token
-	userId, errAuth := authenticateUser(DB, r.Header.Get("Authorization"))
-	if errAuth != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+func handleListPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
+
+	// Get users personal access tokens
+	tokens, err := listPersonalTokens(DB, userId)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	// Get uuid (/api/storage/uploads/{uuid})
-	lastSlashIndex := strings.LastIndex(r.URL.Path, "/")
-	uuid := r.URL.Path[lastSlashIndex+1:]
+	// Send tokens as json array
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
 
-	// Authenticate uuid
-	var uuidValid bool
-	DB.QueryRow("SELECT EXISTS(SELECT 1 FROM files WHERE uuid=? AND owner_id=?)", uuid, userId).Scan(&uuidValid)
-	if !uuidValid {
-		http.Error(w, "Invalid UUID", http.StatusInternalServerError)
+func handleCreatePersonalToken(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
+
+	// Decode token data
+	var tokenReq PersonalTokenReq
+	if err := decodeJSON(w, r, &tokenReq); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	switch r.Method {
-	case http.MethodPut:
-		// Upload chunk
-		if err := uploadChunk(DB, uuid, r.URL.Query().Get("offset"), r.Body); err != nil {
-			http.Error(w, "Upload chunk failed", http.StatusInternalServerError)
-			return
-		}
+	// Create token
+	token, err := createPersonalToken(DB, userId, tokenReq)
+	auditRequest(r, userId, "token.create", token.ID, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Send token, this is the only time it is shown
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(token)
+}
+
+func handleRevokePersonalToken(w http.ResponseWriter, r *http.Request) {
+	userId := principalFrom(r).UserID
 
-		w.WriteHeader(http.StatusOK)
+	tokenId := r.PathValue("id")
 
-	case http.MethodPost:
-		// Finish upload
-		if err := finishUpload(DB, uuid, userId); err != nil {
-			http.Error(w, "Finish upload failed", http.StatusInternalServerError)
+	// Revoke token
+	err := revokePersonalToken(DB, userId, tokenId)
+	auditRequest(r, userId, "token.revoke", tokenId, auditResult(err))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, errTokenNotFound)
 			return
 		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-		w.WriteHeader(http.StatusOK)
+func handleListInvites(w http.ResponseWriter, r *http.Request) {
+	// Get invites with their redemptions
+	inviteTokens, err := listInvites(DB)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Senf tokens as json array
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inviteTokens)
+}
+
+func handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	// Decode invite settings, an empty body keeps the defaults
+	var inviteReq InviteReq
+	if err := decodeJSON(w, r, &inviteReq); err != nil && err != errEmptyBody {
+		writeError(w, err)
+		return
+	}
+	if err := validateInviteReq(inviteReq); err != nil {
+		writeError(w, err)
+		return
+	}
 
-	default:
-		http.Error(w, "Invalid method", http.StatusBadRequest)
+	// Create invite token
+	adminId := principalFrom(r).UserID
+	invite, errCreateInvite := createInviteToken(DB, adminId, inviteReq)
+	auditRequest(r, adminId, "invite.create", invite.ID, auditResult(errCreateInvite))
+	if errCreateInvite != nil {
+		writeError(w, errCreateInvite)
 		return
 	}
+
+	// Send invite token
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invite)
 }
 
-func handleFile(w http.ResponseWriter, r *http.Request) {
-	// Get uuid (/api/storage/file/{uuid})
-	lastSlashIndex := strings.LastIndex(r.URL.Path, "/")
-	uuid := r.URL.Path[lastSlashIndex+1:]
+func handleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	invite := r.PathValue("invite")
 
-	switch r.Method {
-	case http.MethodGet:
-		// Authenticate user
-		userId, err := authenticateUser(DB, r.URL.Query().Get("auth"))
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	// Revoke invite, log the id rather than a raw token
+	target := invite
+	if _, errId := strconv.Atoi(invite); errId != nil {
+		target = hashToken(invite)
+	}
+	adminId := principalFrom(r).UserID
+	err := revokeInvite(DB, invite)
+	auditRequest(r, adminId, "invite.revoke", target, auditResult(err))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, errInviteNotFound)
 			return
 		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-		// Authenticate uuid
-		var uuidValid bool
-		DB.QueryRow("SELECT EXISTS(SELECT 1 FROM files WHERE uuid=? AND owner_id=?)", uuid, userId).Scan(&uuidValid)
-		if !uuidValid {
-			http.Error(w, "Invalid UUID", http.StatusBadRequest)
-			return
-		}
+func handleListLockouts(w http.ResponseWriter, r *http.Request) {
+	// Get tracked login attempts
+	attempts, err := listThrottles(DB)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-		file, mime, safeName, modTime, errGetFile := getFileByUUID(DB, userId, uuid)
-		if errGetFile != nil {
-			http.Error(w, "Get file failed", http.StatusInternalServerError)
-			return
+	// Send attempts as json array
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attempts)
+}
 
-		}
-		w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(safeName))
-		// Set headers
-		if mime != "" {
-			w.Header().Set("Content-Type", mime)
-		} else {
-			w.Header().Set("Content-Type", "application/octet-stream")
-		}
+func handleResetLockout(w http.ResponseWriter, r *http.Request) {
+	// Lift a lockout (/api/admin/lockouts?key=user:name)
+	key := r.URL.Query().Get("key")
+	adminId := principalFrom(r).UserID
+	if key == "" {
+		auditRequest(r, adminId, "lockout.reset", key, AuditFailure)
+		writeError(w, invalidRequest("missing key"))
+		return
+	}
 
-		// http.ServeContent uses the provided modtime; we can use fi.ModTime()
-		http.ServeContent(w, r, safeName, modTime, file)
+	reset, err := resetThrottle(DB, key)
+	if err == nil && reset == 0 {
+		err = errLockoutNotFound
+	}
+	auditRequest(r, adminId, "lockout.reset", key, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	case http.MethodPatch:
-		// Authenticate user
-		userId, err := authenticateUser(DB, r.Header.Get("Authorization"))
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	// Get filter (/api/admin/audit?actor=&action=user.*&from=&to=&before=&limit=)
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-		// Authenticate uuid
-		var uuidValid bool
-		DB.QueryRow("SELECT EXISTS(SELECT 1 FROM files WHERE uuid=? AND owner_id=?)", uuid, userId).Scan(&uuidValid)
-		if !uuidValid {
-			http.Error(w, "Invalid UUID", http.StatusInternalServerError)
-			return
-		}
+	// Get page of events, newest first
+	events, err := listAuditEvents(DB, filter)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-		// Rename file
-		if err := renameFile(DB, uuid, r.URL.Query().Get("name")); err != nil {
-			http.Error(w, "Rename file failed", http.StatusInternalServerError)
-			return
-		}
+	// Send events as json array
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
 
-	case http.MethodDelete:
-		// Authenticate user
-		userId, err := authenticateUser(DB, r.Header.Get("Authorization"))
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+func handleListUsers(w http.ResponseWriter, r *http.Request) {
+	// Get users with usage
+	users, err := listUsers(DB)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Send users as json array
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
 
-		// Authenticate uuid
-		var uuidValid bool
-		DB.QueryRow("SELECT EXISTS(SELECT 1 FROM files WHERE uuid=? AND owner_id=?)", uuid, userId).Scan(&uuidValid)
-		if !uuidValid {
-			http.Error(w, "Invalid UUID", http.StatusInternalServerError)
+// pathUserId reads the {id} path parameter of the admin user routes.
+func pathUserId(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, invalidRequest("Invalid user id"))
+		return 0, false
+	}
+	return userId, true
+}
+
+func handleGetAdminUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := pathUserId(w, r)
+	if !ok {
+		return
+	}
+
+	// Get user
+	user, err := getAdminUser(DB, userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, errUserNotFound)
 			return
 		}
+		writeError(w, err)
+		return
+	}
+
+	// Send user
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
 
-		// Delete file
-		if err := deleteFile(DB, userId, uuid); err != nil {
-			http.Error(w, "Delete file failed", http.StatusInternalServerError)
+func handlePatchAdminUser(w http.ResponseWriter, r *http.Request) {
+	userId, ok := pathUserId(w, r)
+	if !ok {
+		return
+	}
+
+	// Decode changes
+	var patch AdminUserPatchReq
+	if err := decodeJSON(w, r, &patch); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateUserPatch(patch); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Update user
+	err := patchUser(DB, userId, patch)
+	adminId := principalFrom(r).UserID
+	auditRequest(r, adminId, "admin.user.update", "user:"+strconv.Itoa(userId), auditResult(err))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, errUserNotFound)
 			return
 		}
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleResetUserTOTP(w http.ResponseWriter, r *http.Request) {
+	userId, ok := pathUserId(w, r)
+	if !ok {
+		return
+	}
+
+	// Reset users 2fa
+	err := disableTOTP(DB, userId)
+	adminId := principalFrom(r).UserID
+	auditRequest(r, adminId, "admin.2fa.reset", "user:"+strconv.Itoa(userId), auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	default:
-		http.Error(w, "Invalid method", http.StatusBadRequest)
+func handleStartUpload(w http.ResponseWriter, r *http.Request) {
+	// Get upload data
+	var upload UploadReq
+	if err := decodeJSON(w, r, &upload); err != nil {
+		writeError(w, err)
 		return
 	}
+
+	// The target folder or file is only known from the body
+	p := principalFrom(r)
+	errAccess := authorizeFolder(p, ScopeUpload, upload.Path)
+	if upload.FileUUID != "" {
+		errAccess = authorizeFile(DB, p, upload.FileUUID, ScopeUpload, errFileNotFound)
+	}
+	if errAccess != nil {
+		writeError(w, errAccess)
+		return
+	}
+	userId := p.UserID
+
+	// Register an upload
+	uuid, complete, errUploadStart := startUpload(DB, userId, upload)
+	auditRequest(r, userId, "upload.start", upload.Path+"/"+upload.Filename, auditResult(errUploadStart))
+	if errUploadStart != nil {
+		writeError(w, errUploadStart)
+		return
+	}
+
+	// Respond with uuid, complete uploads need no chunks
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"upload_id":"` + uuid + `","complete":` + strconv.FormatBool(complete) + `}`))
 }
 
-func handleFiles(w http.ResponseWriter, r *http.Request) {
-	// Get path (/api/storage/files/{path})
-	var endpoint = "/api/storage/files/"
-	pathStartIndex := len(endpoint)
-	pathToFolder := r.URL.Path[pathStartIndex:]
+func handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
 
-	// Authenticate auth token
-	userId, errAuth := authenticateUser(DB, r.Header.Get("Authorization"))
-	if errAuth != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	// Upload chunk
+	offset, err := uploadChunk(DB, uuid, r.URL.Query().Get("offset"), r.Body)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		// Get folder contents
-		contents, errList := listFolderContents(DB, pathToFolder, userId)
-		if errList != nil {
-			http.Error(w, "Geting folder contents failed", http.StatusInternalServerError)
-			return
-		}
-		// Marshal to JSON
-		out, err := json.Marshal(contents)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUploadStatus answers GET and HEAD, HEAD only with the headers.
+func handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	status, _, err := uploadStatus(DB, r.PathValue("uuid"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(status.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(status.SizeBytes, 10))
+	w.Header().Set("Upload-State", status.State)
+	if status.ExpiresAt != nil {
+		w.Header().Set("Upload-Expires", status.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func handleFinishUpload(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	userId := principalFrom(r).UserID
+
+	// Finish upload
+	err := finishUpload(DB, uuid)
+	auditRequest(r, userId, "upload.finish", uuid, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleDownloadFile(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	userId := principalFrom(r).UserID
+
+	storedName, size, mime, safeName, modTime, errGetFile := getFileByUUID(DB, userId, uuid)
+	if errGetFile != nil {
+		writeError(w, errGetFile)
+		return
+
+	}
+	serveFile(w, r, storedName, size, mime, safeName, modTime)
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, storedName string, size int64, mime, safeName string, modTime time.Time) {
+	// Stores that can sign urls serve the download themselves
+	if signer, ok := Store.(URLSigner); ok {
+		signedURL, err := signer.SignedURL(storedName, safeName, mime)
 		if err != nil {
-			http.Error(w, "Marshal contents to json failed", http.StatusInternalServerError)
+			log.Printf("Couldnt sign url: %s", err.Error())
+			writeError(w, err)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(out)
-
-	case http.MethodPost:
-		if err := createFolder(DB, pathToFolder, userId); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if signedURL != "" {
+			http.Redirect(w, r, signedURL, http.StatusFound)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+	}
 
-	case http.MethodDelete:
-		if err := deleteFolder(DB, pathToFolder, userId); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
+	file := &blobReader{store: Store, name: storedName, size: size}
+	defer file.Close()
+
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(safeName))
+	// Set headers
+	if mime != "" {
+		w.Header().Set("Content-Type", mime)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	// http.ServeContent uses the provided modtime of the stored content
+	http.ServeContent(w, r, safeName, modTime, file)
+}
+
+// pathVersion reads the {version} path parameter of the version routes.
+func pathVersion(w http.ResponseWriter, r *http.Request) (int, bool) {
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		writeError(w, errVersionNotFound)
+		return 0, false
+	}
+	return version, true
+}
+
+func handleListVersions(w http.ResponseWriter, r *http.Request) {
+	// Get versions, newest first
+	versions, err := listVersions(DB, r.PathValue("uuid"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Send versions as json array
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+func handleDownloadVersion(w http.ResponseWriter, r *http.Request) {
+	version, ok := pathVersion(w, r)
+	if !ok {
+		return
+	}
 
-	case http.MethodPatch:
-		if err := renameFolder(DB, pathToFolder, r.URL.Query().Get("name"), userId); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	storedName, size, mime, safeName, modTime, err := getFileVersion(DB, r.PathValue("uuid"), version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	serveFile(w, r, storedName, size, mime, safeName, modTime)
+}
+
+func handleRestoreVersion(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	userId := principalFrom(r).UserID
+	version, ok := pathVersion(w, r)
+	if !ok {
+		return
+	}
+
+	// Restore version as a new one
+	err := restoreVersion(DB, userId, uuid, version)
+	auditRequest(r, userId, "file.version.restore", uuid+"@"+strconv.Itoa(version), auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleRenameFile(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	userId := principalFrom(r).UserID
+
+	// Rename file
+	err := renameFile(DB, uuid, r.URL.Query().Get("name"))
+	auditRequest(r, userId, "file.rename", uuid, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+// decodeMove decodes the target of a move or copy and checks that p may
+// write to it.
+func decodeMove(w http.ResponseWriter, r *http.Request, p *Principal) (MoveReq, bool) {
+	var move MoveReq
+	if err := decodeJSON(w, r, &move); err != nil {
+		writeError(w, err)
+		return move, false
+	}
+	if err := authorizeFolder(p, ScopeWrite, move.Path); err != nil {
+		writeError(w, err)
+		return move, false
+	}
+	return move, true
+}
+
+func handleMoveFile(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	p := principalFrom(r)
+	move, ok := decodeMove(w, r, p)
+	if !ok {
+		return
+	}
+
+	// Move file
+	moved, err := moveFile(DB, p.UserID, uuid, move)
+	auditRequest(r, p.UserID, "file.move", uuid, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(moved)
+}
+
+func handleCopyFile(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	p := principalFrom(r)
+	move, ok := decodeMove(w, r, p)
+	if !ok {
+		return
+	}
+
+	// Copy file
+	copied, err := copyFile(DB, p.UserID, uuid, move)
+	auditRequest(r, p.UserID, "file.copy", uuid, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(copied)
+}
+
+func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	userId := principalFrom(r).UserID
+
+	// Move file to the trash
+	err := trashFile(DB, userId, uuid)
+	auditRequest(r, userId, "file.delete", uuid, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func handleListFolder(w http.ResponseWriter, r *http.Request) {
+	pathToFolder := r.PathValue("path")
+	userId := principalFrom(r).UserID
+
+	// Get folder contents
+	contents, errList := listFolderContents(DB, pathToFolder, userId)
+	if errList != nil {
+		writeError(w, errList)
+		return
+	}
+	// Marshal to JSON
+	out, err := json.Marshal(contents)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+func handleCreateFolder(w http.ResponseWriter, r *http.Request) {
+	pathToFolder := r.PathValue("path")
+	userId := principalFrom(r).UserID
+
+	err := createFolder(DB, pathToFolder, userId)
+	auditRequest(r, userId, "folder.create", pathToFolder, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleDeleteFolder(w http.ResponseWriter, r *http.Request) {
+	pathToFolder := r.PathValue("path")
+	userId := principalFrom(r).UserID
+
+	err := trashFolder(DB, pathToFolder, userId)
+	auditRequest(r, userId, "folder.delete", pathToFolder, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleRenameFolder(w http.ResponseWriter, r *http.Request) {
+	pathToFolder := r.PathValue("path")
+	userId := principalFrom(r).UserID
+
+	err := renameFolder(DB, pathToFolder, r.URL.Query().Get("name"), userId)
+	auditRequest(r, userId, "folder.rename", pathToFolder, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleMoveFolder(w http.ResponseWriter, r *http.Request) {
+	pathToFolder := r.PathValue("path")
+	p := principalFrom(r)
+	move, ok := decodeMove(w, r, p)
+	if !ok {
+		return
+	}
+
+	moved, err := moveFolder(DB, p.UserID, pathToFolder, move)
+	auditRequest(r, p.UserID, "folder.move", pathToFolder, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(moved)
+}
+
+func handleCopyFolder(w http.ResponseWriter, r *http.Request) {
+	pathToFolder := r.PathValue("path")
+	p := principalFrom(r)
+	move, ok := decodeMove(w, r, p)
+	if !ok {
+		return
+	}
+
+	copied, err := copyFolder(DB, p.UserID, pathToFolder, move)
+	auditRequest(r, p.UserID, "folder.copy", pathToFolder, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(copied)
+}
+
+func handleListTrash(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+
+	// Get trash, personal access tokens only see their folder
+	items, err := listTrash(DB, p.UserID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	items = slices.DeleteFunc(items, func(item TrashItem) bool {
+		return !p.allows(ScopeRead, item.Path)
+	})
+
+	// Send items as json array
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+func handleRestoreTrashItem(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+
+	// Decode target, an empty body restores to the original path
+	var restore RestoreReq
+	if err := decodeJSON(w, r, &restore); err != nil && err != errEmptyBody {
+		writeError(w, err)
+		return
+	}
+
+	// Get item
+	item, err := getTrashItem(DB, p.UserID, r.PathValue("kind"), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	path, name := item.Path, item.Name
+	if restore.Path != "" {
+		path = restore.Path
+	}
+	if restore.Name != "" {
+		name = restore.Name
+	}
+	for _, folder := range []string{item.Path, path} {
+		if err := authorizeFolder(p, ScopeWrite, folder); err != nil {
+			writeError(w, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+	}
+
+	// Restore item
+	err = restoreTrashItem(DB, p.UserID, item, path, name)
+	auditRequest(r, p.UserID, "trash.restore", item.Type+":"+item.ID, auditResult(err))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
 
-	default:
-		http.Error(w, "Unsupported method", http.StatusBadRequest)
+	// Get trash
+	items, err := listTrash(DB, p.UserID)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
+
+	// Purge what the token may write
+	for _, item := range items {
+		if !p.allows(ScopeWrite, item.Path) {
+			continue
+		}
+		if err := purgeTrashItem(DB, item); err != nil {
+			auditRequest(r, p.UserID, "trash.empty", "", AuditFailure)
+			writeError(w, err)
+			return
+		}
+	}
+	auditRequest(r, p.UserID, "trash.empty", "", AuditSuccess)
+	w.WriteHeader(http.StatusOK)
 }
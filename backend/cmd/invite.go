@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errInviteUsername = &APIError{Status: http.StatusForbidden, Code: "invite_username", Message: "Invite is for another username"}
+
+func validateInviteReq(inviteReq InviteReq) error {
+	if inviteReq.Role != "" && inviteReq.Role != "user" && inviteReq.Role != "admin" {
+		return invalidRequest("invalid role")
+	}
+	if inviteReq.QuotaBytes != nil && *inviteReq.QuotaBytes < 0 {
+		return invalidRequest("quota must not be negative")
+	}
+	if inviteReq.MaxUses != nil && *inviteReq.MaxUses < 1 {
+		return invalidRequest("max uses must be at least 1")
+	}
+	if inviteReq.ExpiresAt != nil && inviteReq.ExpiresAt.Before(time.Now()) {
+		return invalidRequest("expiry is in the past")
+	}
+	if inviteReq.Username != "" && inviteReq.MaxUses != nil && *inviteReq.MaxUses > 1 {
+		return invalidRequest("invites for a username can only be used once")
+	}
+	return nil
+}
+
+func createInviteToken(db *sql.DB, createdBy int, inviteReq InviteReq) (InviteWrapper, error) {
+	var token string
+	for {
+		// generate token
+		token = generateRawToken()
+
+		// check if token already exists
+		var tokenExists bool
+		db.QueryRow("SELECT EXISTS(SELECT 1 FROM invite_tokens WHERE token=?)", hashToken(token)).Scan(&tokenExists)
+		if tokenExists {
+			continue
+		}
+
+		// create token if the token is unique
+		break
+	}
+
+	// apply defaults
+	invite := InviteWrapper{
+		ID:         hashToken(token),
+		Token:      token,
+		Role:       "user",
+		QuotaBytes: Conf.DefaultQuotaBytes,
+		MaxUses:    1,
+		Username:   inviteReq.Username,
+		Note:       inviteReq.Note,
+		RedeemedBy: make([]InviteRedemptionWrapper, 0),
+	}
+	if inviteReq.Role != "" {
+		invite.Role = inviteReq.Role
+	}
+	if inviteReq.QuotaBytes != nil {
+		invite.QuotaBytes = *inviteReq.QuotaBytes
+	}
+	if inviteReq.MaxUses != nil {
+		invite.MaxUses = *inviteReq.MaxUses
+	}
+	expiresAt := time.Now().Add(Conf.InviteTTL).UTC()
+	if inviteReq.ExpiresAt != nil {
+		expiresAt = inviteReq.ExpiresAt.UTC()
+	}
+	invite.ExpiresAt = expiresAt.String()
+
+	// inster token in db
+	_, err := db.Exec(`INSERT INTO invite_tokens (token, token_hashed, created_at, expires_at, role, quota_bytes, max_uses, uses, username, note, created_by) VALUES (?, 1, ?, ?, ?, ?, ?, 0, ?, ?, ?)`,
+		invite.ID, time.Now().UTC(), expiresAt, invite.Role, invite.QuotaBytes, invite.MaxUses, invite.Username, invite.Note, createdBy)
+	if err != nil {
+		log.Println("Could not insert invite token")
+		return invite, err
+	}
+	return invite, nil
+}
+
+func listInvites(db *sql.DB) ([]InviteWrapper, error) {
+	invites := make([]InviteWrapper, 0)
+
+	// Query db for tokens
+	rows, err := db.Query(`SELECT token, expires_at, role, quota_bytes, max_uses, uses, username, note FROM invite_tokens ORDER BY expires_at`)
+	if err != nil {
+		log.Printf("Couldnt get invites: %s", err.Error())
+		return invites, err
+	}
+
+	// Process tokens into structs
+	for rows.Next() {
+		var invite InviteWrapper
+		if err := rows.Scan(&invite.ID, &invite.ExpiresAt, &invite.Role, &invite.QuotaBytes, &invite.MaxUses, &invite.Uses, &invite.Username, &invite.Note); err != nil {
+			rows.Close()
+			log.Printf("Couldnt scan invite rows: %s", err.Error())
+			return invites, err
+		}
+		invite.RedeemedBy = make([]InviteRedemptionWrapper, 0)
+		invites = append(invites, invite)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return invites, err
+	}
+
+	// Add who redeemed them
+	for i := range invites {
+		redemptions, err := db.Query(`SELECT COALESCE(r.user_id, 0), COALESCE(u.username, ''), r.redeemed_at FROM invite_redemptions r LEFT JOIN users u ON u.id = r.user_id WHERE r.invite_token = ? ORDER BY r.redeemed_at`, invites[i].ID)
+		if err != nil {
+			return invites, err
+		}
+		for redemptions.Next() {
+			var redemption InviteRedemptionWrapper
+			if err := redemptions.Scan(&redemption.UserID, &redemption.Username, &redemption.RedeemedAt); err != nil {
+				redemptions.Close()
+				return invites, err
+			}
+			invites[i].RedeemedBy = append(invites[i].RedeemedBy, redemption)
+		}
+		redemptions.Close()
+	}
+
+	return invites, nil
+}
+
+// revokeInvite deletes an invite by its id, the raw token is accepted as well.
+func revokeInvite(db *sql.DB, invite string) error {
+	result, err := db.Exec(`DELETE FROM invite_tokens WHERE token IN (?, ?)`, strings.ToLower(invite), hashToken(invite))
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// redeemInvite uses up one use of an invite and creates the user it is for.
+// Both happen in one transaction, so a failed registration keeps the use.
+func redeemInvite(db *sql.DB, inviteToken, username, passwordHash string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Get invite settings
+	now := time.Now().UTC()
+	tokenHash := hashToken(inviteToken)
+	var role, inviteUsername string
+	var quotaBytes int64
+	if err := tx.QueryRow(`SELECT role, quota_bytes, username FROM invite_tokens WHERE token = ? AND expires_at > ? AND uses < max_uses`, tokenHash, now).Scan(&role, &quotaBytes, &inviteUsername); err != nil {
+		return 0, err
+	}
+	if inviteUsername != "" && inviteUsername != username {
+		return 0, errInviteUsername
+	}
+
+	// Use invite
+	result, err := tx.Exec(`UPDATE invite_tokens SET uses = uses + 1 WHERE token = ? AND uses < max_uses`, tokenHash)
+	if err != nil {
+		return 0, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	// Create user and remember who used the invite
+	userId, err := insertUser(tx, username, passwordHash, role, quotaBytes)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO invite_redemptions (invite_token, user_id, redeemed_at) VALUES (?, ?, ?)`, tokenHash, userId, now); err != nil {
+		return 0, err
+	}
+
+	return userId, tx.Commit()
+}
@@ -1,46 +1,131 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 )
 
-const (
-    DBPath     				= "./data/drive.db"
-    StorageRoot   				= "./files"
-    DefaultQuotaBytes   	= 25 * 1000 * 1000 * 1000
-	InviteTokenValidHours 	= 24
-	AuthTokenValidHours 	= 6
-)
 var DB *sql.DB;
 
 func main() {
 	log.Println("Starting server")
 
+	// Config from file, environment and flags
+	config, args, printConfig, err := loadConfig(os.Args[1:])
+	if err != nil { log.Fatal(err) }
+	Conf = config
+	OIDC = Conf.OIDC
+	if printConfig { fmt.Print(Conf); return }
+	log.Printf("Effective config:\n%s", Conf)
+
+	if err := os.MkdirAll(filepath.Dir(Conf.DBPath), 0o755); err != nil { log.Fatal(err) }
+	if err := os.MkdirAll(Conf.StorageRoot, 0o755); err != nil { log.Fatal(err) }
+
 	log.Println("Opening db")
-	var err error
-	DB, err = openDB(DBPath)
+	DB, err = openDB(Conf.DBPath)
 	if err != nil { log.Fatal(err) }
 	if DB == nil {log.Fatal("DB is nil\n")}
 
-	log.Println("Running sql")
-	if err := runSqlFromFile(DB,"./migrations/init.sql"); err != nil { log.Fatal(err) }
-	if err := runSqlFromFile(DB,"./migrations/dummy.sql"); err != nil { log.Fatal(err) } // dummy data
+	// Migration commands work on the schema as it is
+	if len(args) > 0 && args[0] == "migrate" { os.Exit(runCommand(args)) }
+
+	log.Println("Migrating db")
+	if _, err := migrateUp(DB, 0); err != nil { log.Fatal(err) }
+	if err := resolveLegacyNames(DB, Conf.StorageRoot); err != nil { log.Fatal(err) }
+
+	log.Printf("Opening %s storage", Conf.Storage.Driver)
+	Store, err = openStore(Conf.Storage.Driver)
+	if err != nil { log.Fatal(err) }
+
+	// Command line commands
+	if len(args) > 0 { os.Exit(runCommand(args)) }
+
+	if OIDC.enabled() { log.Printf("Oidc login enabled for %s", OIDC.Issuer) }
 
 	log.Println("Setting up handlers")
+	rt := newRouter()
+	authed := rt.With(authenticate)
+	account := authed.With(requireScope(ScopeAccount))
+	admin := account.With(requireAdmin)
 	// Users
-	http.Handle("/api/users/login", corsMiddleware(http.HandlerFunc(handleAuth))) 				// POST
-	http.Handle("/api/users/register", corsMiddleware(http.HandlerFunc(handleRegister))) 		// POST
-	http.Handle("/api/users/me", corsMiddleware(http.HandlerFunc(handleUser))) 					// GET PATCH DELETE
+	rt.Handle("POST", "/api/users/login", handleAuth)
+	rt.Handle("POST", "/api/users/login/2fa", handleAuthSecondFactor)
+	rt.Handle("GET", "/api/users/oidc/login", handleOIDCLogin)
+	rt.Handle("GET", "/api/users/oidc/callback", handleOIDCCallback)
+	rt.Handle("POST", "/api/users/refresh", handleRefresh)
+	rt.Handle("POST", "/api/users/register", handleRegister)
+	account.Handle("GET", "/api/users/me", handleGetUser)
+	account.Handle("PATCH", "/api/users/me", handleUpdateUser)
+	account.Handle("DELETE", "/api/users/me", handleDeleteUser)
+	account.Handle("POST", "/api/users/me/logout", handleLogout)
+	account.Handle("GET", "/api/users/me/sessions", handleListSessions)
+	account.Handle("DELETE", "/api/users/me/sessions", handleRevokeOtherSessions)
+	account.Handle("DELETE", "/api/users/me/sessions/{id}", handleRevokeSession)
+	account.Handle("POST", "/api/users/me/2fa", handleEnrollTOTP)
+	account.Handle("DELETE", "/api/users/me/2fa", handleDisableTOTP)
+	account.Handle("POST", "/api/users/me/2fa/confirm", handleConfirmTOTP)
+	account.Handle("POST", "/api/users/me/oidc", handleOIDCLink)
+	account.Handle("GET", "/api/users/me/tokens", handleListPersonalTokens)
+	account.Handle("POST", "/api/users/me/tokens", handleCreatePersonalToken)
+	account.Handle("DELETE", "/api/users/me/tokens/{id}", handleRevokePersonalToken)
 	// Admin
-	http.Handle("/api/admin/invites", corsMiddleware(http.HandlerFunc(handleInvites)))			// GET POST
-	// Storage
-	http.Handle("/api/storage/upload", corsMiddleware(http.HandlerFunc(handleUploads)))			// POST
-	http.Handle("/api/storage/uploads/", corsMiddleware(http.HandlerFunc(handleUploadProcess)))	// PUT POST
-	http.Handle("/api/storage/file/", corsMiddleware(http.HandlerFunc(handleFile)))				// GET PATCH DELETE
-	http.Handle("/api/storage/files/", corsMiddleware(http.HandlerFunc(handleFiles)))			// GET POST PATCH DELETE
+	admin.Handle("GET", "/api/admin/invites", handleListInvites)
+	admin.Handle("POST", "/api/admin/invites", handleCreateInvite)
+	admin.Handle("DELETE", "/api/admin/invites/{invite}", handleRevokeInvite)
+	admin.Handle("GET", "/api/admin/lockouts", handleListLockouts)
+	admin.Handle("DELETE", "/api/admin/lockouts", handleResetLockout)
+	admin.Handle("GET", "/api/admin/audit", handleAudit)
+	admin.Handle("GET", "/api/admin/users", handleListUsers)
+	admin.Handle("GET", "/api/admin/users/{id}", handleGetAdminUser)
+	admin.Handle("PATCH", "/api/admin/users/{id}", handlePatchAdminUser)
+	admin.Handle("DELETE", "/api/admin/users/{id}/2fa", handleResetUserTOTP)
+	// Storage, the policy checks access to the file or folder of the route
+	uploads := authed.With(fileAccess(ScopeUpload, errUploadNotFound))
+	readFile := authed.With(fileAccess(ScopeRead, errFileNotFound))
+	downloadFile := rt.With(authenticateDownload, fileAccess(ScopeRead, errFileNotFound))
+	writeFile := authed.With(fileAccess(ScopeWrite, errFileNotFound))
+	readFolder := authed.With(folderAccess(ScopeRead))
+	writeFolder := authed.With(folderAccess(ScopeWrite))
+	authed.Handle("POST", "/api/storage/upload", handleStartUpload)
+	uploads.Handle("GET", "/api/storage/uploads/{uuid}", handleUploadStatus)
+	uploads.Handle("PUT", "/api/storage/uploads/{uuid}", handleUploadChunk)
+	uploads.Handle("POST", "/api/storage/uploads/{uuid}", handleFinishUpload)
+	downloadFile.Handle("GET", "/api/storage/file/{uuid}", handleDownloadFile)
+	writeFile.Handle("PATCH", "/api/storage/file/{uuid}", handleRenameFile)
+	writeFile.Handle("DELETE", "/api/storage/file/{uuid}", handleDeleteFile)
+	writeFile.Handle("POST", "/api/storage/file/{uuid}/move", handleMoveFile)
+	readFile.Handle("POST", "/api/storage/file/{uuid}/copy", handleCopyFile)
+	readFile.Handle("GET", "/api/storage/file/{uuid}/versions", handleListVersions)
+	downloadFile.Handle("GET", "/api/storage/file/{uuid}/versions/{version}", handleDownloadVersion)
+	writeFile.Handle("POST", "/api/storage/file/{uuid}/versions/{version}", handleRestoreVersion)
+	readFolder.Handle("GET", "/api/storage/files/{path...}", handleListFolder)
+	writeFolder.Handle("POST", "/api/storage/files/{path...}", handleCreateFolder)
+	writeFolder.Handle("PATCH", "/api/storage/files/{path...}", handleRenameFolder)
+	writeFolder.Handle("DELETE", "/api/storage/files/{path...}", handleDeleteFolder)
+	writeFolder.Handle("POST", "/api/storage/move/{path...}", handleMoveFolder)
+	readFolder.Handle("POST", "/api/storage/copy/{path...}", handleCopyFolder)
+	// Trash, items are checked against the folder they were deleted from
+	authed.With(requireScope(ScopeRead)).Handle("GET", "/api/storage/trash", handleListTrash)
+	authed.With(requireScope(ScopeWrite)).Handle("DELETE", "/api/storage/trash", handleEmptyTrash)
+	authed.With(requireScope(ScopeWrite)).Handle("POST", "/api/storage/trash/{kind}/{id}", handleRestoreTrashItem)
+	handler := rt.Handler(logRequests, corsMiddleware)
 
+	// Stop on ctrl+c or SIGTERM, a second signal kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	jobs := startJobs(ctx)
+
+	servers, err := startServers(ctx, jobs, handler)
+	if err != nil { log.Fatal(err) }
 	log.Println("Server is up")
-	log.Fatal((http.ListenAndServe(":8000", nil)))
+
+	<-ctx.Done()
+	stop()
+	shutdownServers(jobs, servers...)
 }
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Policies for a name that is taken in the target folder
+const (
+	ConflictFail      = "fail"
+	ConflictRename    = "rename"
+	ConflictOverwrite = "overwrite"
+)
+
+var (
+	errNameConflict    = &APIError{Status: http.StatusConflict, Code: "name_conflict", Message: "The name is taken in the target folder"}
+	errInvalidConflict = invalidRequest("conflict must be fail, rename or overwrite")
+	errInvalidName     = invalidRequest("Invalid name")
+	errMoveIntoSelf    = invalidRequest("A folder cant be moved or copied into itself")
+	errMoveRoot        = invalidRequest("The root folder cant be moved")
+)
+
+// copyableFiles are the files that are copied along, trashed files, new
+// versions and unfinished uploads stay behind.
+const copyableFiles = `deleted_at IS NULL AND replaces IS NULL AND stored_name NOT LIKE '%.part'`
+
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return errInvalidName.withDetails(map[string]any{"name": name})
+	}
+	return nil
+}
+
+// replacedItem is the item that a move or copy overwrites, the zero value
+// replaces nothing.
+type replacedItem struct {
+	Kind string
+	ID   string
+}
+
+// trash moves the replaced item to the trash. It runs in the transaction of
+// the move or copy, so the item stays where it is when they fail.
+func (item replacedItem) trash(db dbRowExecer, userId int) error {
+	switch item.Kind {
+	case TrashFile:
+		return trashFile(db, userId, item.ID)
+	case TrashFolder:
+		var folderId int
+		fmt.Sscan(item.ID, &folderId)
+		return trashFolderById(db, folderId)
+	}
+	return nil
+}
+
+// resolveName applies the conflict policy to name in the target folder. self
+// is the id of the item, when moving it doesnt conflict with itself and when
+// copying it cant be overwritten by its copy. With ConflictOverwrite it
+// returns the item in the way, the caller trashes it.
+func resolveName(db *sql.DB, userId, folderId int, kind, name, conflict, self string, moving bool) (string, replacedItem, error) {
+	if err := checkName(name); err != nil {
+		return "", replacedItem{}, err
+	}
+	switch conflict {
+	case "", ConflictFail, ConflictRename, ConflictOverwrite:
+	default:
+		return "", replacedItem{}, errInvalidConflict
+	}
+
+	// Get the item using a name
+	taken := func(name string) (string, error) {
+		var id string
+		var err error
+		switch kind {
+		case TrashFile:
+			err = db.QueryRow(`SELECT uuid FROM files WHERE folder_id = ? AND display_name = ? AND deleted_at IS NULL AND replaces IS NULL`, folderId, name).Scan(&id)
+		case TrashFolder:
+			err = db.QueryRow(`SELECT CAST(id AS TEXT) FROM folders WHERE parent_id = ? AND name = ?`, folderId, name).Scan(&id)
+		}
+		if err == sql.ErrNoRows || (moving && id == self) {
+			return "", nil
+		}
+		return id, err
+	}
+
+	id, err := taken(name)
+	if err != nil || id == "" {
+		return name, replacedItem{}, err
+	}
+	if id == self && conflict == ConflictOverwrite {
+		return "", replacedItem{}, errNameConflict.withDetails(map[string]any{"name": name})
+	}
+	switch conflict {
+	case "", ConflictFail:
+		return "", replacedItem{}, errNameConflict.withDetails(map[string]any{"name": name})
+
+	case ConflictRename:
+		// Count up until a name is free, files keep their extension
+		base, ext := name, ""
+		if kind == TrashFile {
+			ext = filepath.Ext(name)
+			base = strings.TrimSuffix(name, ext)
+		}
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+			id, err := taken(candidate)
+			if err != nil || id == "" {
+				return candidate, replacedItem{}, err
+			}
+		}
+
+	case ConflictOverwrite:
+		// The item that is in the way goes to the trash
+		return name, replacedItem{Kind: kind, ID: id}, nil
+	}
+	return "", replacedItem{}, errInvalidConflict
+}
+
+// subfolderOf reports whether folderId is ancestorId or one of its subfolders.
+func subfolderOf(db *sql.DB, folderId, ancestorId int) (bool, error) {
+	var inside bool
+	err := db.QueryRow(folderTree+`SELECT EXISTS(SELECT 1 FROM tree WHERE id = ?)`, ancestorId, folderId).Scan(&inside)
+	return inside, err
+}
+
+// moveFile moves a file to the folder at move.Path, optionally renaming it.
+func moveFile(db *sql.DB, userId int, uuid string, move MoveReq) (MoveWrapper, error) {
+	// Get target folder and name
+	folderId, err := getFolderIdFromPath(db, move.Path, userId)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	name := move.Name
+	if name == "" {
+		if err := db.QueryRow(`SELECT display_name FROM files WHERE uuid = ?`, uuid).Scan(&name); err != nil {
+			return MoveWrapper{}, err
+		}
+	}
+	name, replaced, err := resolveName(db, userId, folderId, TrashFile, name, move.Conflict, uuid, true)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+
+	// Move file, together with trashing the file it replaces
+	tx, err := db.Begin()
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	defer tx.Rollback()
+	if err := replaced.trash(tx, userId); err != nil {
+		return MoveWrapper{}, err
+	}
+	if _, err := tx.Exec(`UPDATE files SET folder_id = ?, display_name = ? WHERE uuid = ?`, folderId, name, uuid); err != nil {
+		return MoveWrapper{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return MoveWrapper{}, err
+	}
+	return MoveWrapper{UUID: uuid, Path: move.Path, Name: name}, nil
+}
+
+// copyFile copies the current version of a file to the folder at move.Path.
+// The copy is a new file and counts toward the quota.
+func copyFile(db *sql.DB, userId int, uuid string, move MoveReq) (MoveWrapper, error) {
+	// Get the file
+	files, err := queryStoredFiles(db, ``, `uuid = ?`, uuid)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	if len(files) == 0 {
+		return MoveWrapper{}, errFileNotFound
+	}
+	f := files[0]
+
+	// Get target folder and name
+	folderId, err := getFolderIdFromPath(db, move.Path, userId)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	if move.Name != "" {
+		f.Name = move.Name
+	}
+	name, replaced, err := resolveName(db, userId, folderId, TrashFile, f.Name, move.Conflict, uuid, false)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	f.Name, f.FolderID = name, folderId
+
+	copies, err := copyFiles(db, userId, []storedFile{f}, nil, replaced)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	return MoveWrapper{UUID: copies[0].UUID, Path: move.Path, Name: f.Name}, nil
+}
+
+// moveFolder moves a folder with everything in it below the folder at
+// move.Path, optionally renaming it.
+func moveFolder(db *sql.DB, userId int, folderPath string, move MoveReq) (MoveWrapper, error) {
+	// Get folder, the root has nowhere to go
+	folderId, err := getFolderIdFromPath(db, folderPath, userId)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	if !strings.Contains(folderPath, "/") {
+		return MoveWrapper{}, errMoveRoot
+	}
+
+	// Get target folder, it cant be inside the folder
+	parentId, err := getFolderIdFromPath(db, move.Path, userId)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	if inside, err := subfolderOf(db, parentId, folderId); err != nil || inside {
+		if err == nil {
+			err = errMoveIntoSelf
+		}
+		return MoveWrapper{}, err
+	}
+
+	// Get name
+	name := move.Name
+	if name == "" {
+		name = folderPath[strings.LastIndex(folderPath, "/")+1:]
+	}
+	name, replaced, err := resolveName(db, userId, parentId, TrashFolder, name, move.Conflict, fmt.Sprint(folderId), true)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+
+	// Move folder, together with trashing the folder it replaces
+	tx, err := db.Begin()
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	defer tx.Rollback()
+	if err := replaced.trash(tx, userId); err != nil {
+		return MoveWrapper{}, err
+	}
+	if _, err := tx.Exec(`UPDATE folders SET parent_id = ?, name = ? WHERE id = ?`, parentId, name, folderId); err != nil {
+		if isUniqueViolation(err) {
+			return MoveWrapper{}, errNameConflict.withDetails(map[string]any{"name": name})
+		}
+		return MoveWrapper{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return MoveWrapper{}, err
+	}
+	return MoveWrapper{Path: move.Path, Name: name}, nil
+}
+
+// copyFolder copies a folder with its subfolders and files below the folder
+// at move.Path. The copies count toward the quota.
+func copyFolder(db *sql.DB, userId int, folderPath string, move MoveReq) (MoveWrapper, error) {
+	// Get folder and target folder, which cant be inside it
+	folderId, err := getFolderIdFromPath(db, folderPath, userId)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	parentId, err := getFolderIdFromPath(db, move.Path, userId)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	if inside, err := subfolderOf(db, parentId, folderId); err != nil || inside {
+		if err == nil {
+			err = errMoveIntoSelf
+		}
+		return MoveWrapper{}, err
+	}
+
+	// Get name
+	name := move.Name
+	if name == "" {
+		name = folderPath[strings.LastIndex(folderPath, "/")+1:]
+	}
+	name, replaced, err := resolveName(db, userId, parentId, TrashFolder, name, move.Conflict, fmt.Sprint(folderId), false)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+
+	// Get the tree
+	folders, err := queryStoredFolders(db, folderId)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+	files, err := queryStoredFiles(db, folderTree, `folder_id IN tree`, folderId)
+	if err != nil {
+		return MoveWrapper{}, err
+	}
+
+	// The copied folder goes below the target under its new name
+	for i := range folders {
+		if folders[i].ID == folderId {
+			folders[i].ParentID, folders[i].Name = parentId, name
+		}
+	}
+	if _, err := copyFiles(db, userId, files, folders, replaced); err != nil {
+		return MoveWrapper{}, err
+	}
+	return MoveWrapper{Path: move.Path, Name: name}, nil
+}
+
+type storedFile struct {
+	UUID       string
+	FolderID   int
+	StoredName string
+	Name       string
+	Mime       sql.NullString
+	SizeBytes  int64
+	Sha256     string
+}
+
+type storedFolder struct {
+	ID       int
+	ParentID int
+	Name     string
+}
+
+// queryStoredFiles returns the copyable files matching condition, which can
+// hold a WITH clause for it.
+func queryStoredFiles(db *sql.DB, with, condition string, args ...any) ([]storedFile, error) {
+	files := make([]storedFile, 0)
+
+	rows, err := db.Query(with+`SELECT uuid, folder_id, stored_name, display_name, mime, size_bytes, sha256 FROM files WHERE `+condition+` AND `+copyableFiles, args...)
+	if err != nil {
+		log.Printf("Couldnt get files: %s", err.Error())
+		return files, err
+	}
+	defer rows.Close()
+
+	// Turn sql rows into structs
+	for rows.Next() {
+		var f storedFile
+		if err := rows.Scan(&f.UUID, &f.FolderID, &f.StoredName, &f.Name, &f.Mime, &f.SizeBytes, &f.Sha256); err != nil {
+			log.Printf("Couldnt scan file rows: %s", err.Error())
+			return files, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// queryStoredFolders returns a folder and the folders below it.
+func queryStoredFolders(db *sql.DB, folderId int) ([]storedFolder, error) {
+	folders := make([]storedFolder, 0)
+
+	rows, err := db.Query(folderTree+`SELECT id, COALESCE(parent_id, 0), name FROM folders WHERE id IN tree`, folderId)
+	if err != nil {
+		log.Printf("Couldnt get folders: %s", err.Error())
+		return folders, err
+	}
+	defer rows.Close()
+
+	// Turn sql rows into structs
+	for rows.Next() {
+		var f storedFolder
+		if err := rows.Scan(&f.ID, &f.ParentID, &f.Name); err != nil {
+			log.Printf("Couldnt scan folder rows: %s", err.Error())
+			return folders, err
+		}
+		folders = append(folders, f)
+	}
+	return folders, rows.Err()
+}
+
+// copyFiles registers copies of files together with copies of folders. Copies
+// share the stored content of their file. Files in one of the folders are
+// registered in its copy, folders are copied below the copy of their parent
+// if there is one. The replaced item is trashed together with registering the
+// copies. It returns the copied files with their new uuids.
+func copyFiles(db *sql.DB, userId int, files []storedFile, folders []storedFolder, replaced replacedItem) ([]storedFile, error) {
+	// Reserve space
+	var size int64
+	for _, f := range files {
+		size += f.SizeBytes
+	}
+	if err := reserveQuota(db, userId, size); err != nil {
+		return nil, err
+	}
+
+	// Register copies
+	copies := make([]storedFile, 0, len(files))
+	for _, f := range files {
+		f.UUID = generateFileUUID(db)
+		copies = append(copies, f)
+	}
+	if err := registerCopies(db, userId, copies, folders, replaced); err != nil {
+		releaseQuota(db, userId, size)
+		if isUniqueViolation(err) {
+			return nil, errNameConflict
+		}
+		return nil, err
+	}
+	return copies, nil
+}
+
+func registerCopies(db *sql.DB, userId int, files []storedFile, folders []storedFolder, replaced replacedItem) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Trash the item in the way
+	if err := replaced.trash(tx, userId); err != nil {
+		return err
+	}
+
+	// Create folders, parents before their subfolders
+	copied := make(map[int]int)
+	for len(copied) < len(folders) {
+		progress := false
+		for _, f := range folders {
+			parentId, inTree := copied[f.ParentID]
+			_, done := copied[f.ID]
+			if done || (!inTree && hasFolder(folders, f.ParentID)) {
+				continue
+			}
+			if !inTree {
+				parentId = f.ParentID
+			}
+			res, err := tx.Exec(`INSERT INTO folders (owner_id, name, parent_id) VALUES (?, ?, ?)`, userId, f.Name, parentId)
+			if err != nil {
+				return err
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return err
+			}
+			copied[f.ID] = int(id)
+			progress = true
+		}
+		if !progress {
+			return fmt.Errorf("folders dont form a tree")
+		}
+	}
+
+	// Create files
+	now := time.Now().UTC()
+	for _, f := range files {
+		folderId, ok := copied[f.FolderID]
+		if !ok {
+			folderId = f.FolderID
+		}
+		if _, err := tx.Exec(`INSERT INTO files (uuid, owner_id, folder_id, stored_name, display_name, mime, size_bytes, size_bytes_on_disk, sha256, created_at, author_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			f.UUID, userId, folderId, f.StoredName, f.Name, f.Mime, f.SizeBytes, f.SizeBytes, f.Sha256, now, userId); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// hasFolder reports whether id is one of the folders.
+func hasFolder(folders []storedFolder, id int) bool {
+	for _, f := range folders {
+		if f.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// uploadFile stores content as a finished file in the folder at path.
+func uploadFile(t *testing.T, db *sql.DB, userId int, path, name, content string) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	uuid, _, err := startUpload(db, userId, UploadReq{Path: path, Filename: name, Size_bytes: int64(len(content)), Sha256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploadChunk(db, uuid, "0", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := finishUpload(db, uuid); err != nil {
+		t.Fatal(err)
+	}
+	return uuid
+}
+
+func trashed(t *testing.T, db *sql.DB, uuid string) bool {
+	t.Helper()
+	var deleted bool
+	if err := db.QueryRow(`SELECT deleted_at IS NOT NULL FROM files WHERE uuid = ?`, uuid).Scan(&deleted); err != nil {
+		t.Fatal(err)
+	}
+	return deleted
+}
+
+func TestOverwriteKeepsTargetOnFailure(t *testing.T) {
+	db, userId := setupUploads(t)
+	if err := createFolder(db, "~/docs", userId); err != nil {
+		t.Fatal(err)
+	}
+	source := uploadFile(t, db, userId, "~", "a.txt", "source")
+	target := uploadFile(t, db, userId, "~/docs", "a.txt", "target")
+	overwrite := MoveReq{Path: "~/docs", Conflict: ConflictOverwrite}
+
+	// A copy over the quota
+	if _, err := db.Exec(`UPDATE users SET quota_bytes = used_bytes WHERE id = ?`, userId); err != nil {
+		t.Fatal(err)
+	}
+	var apiErr *APIError
+	if _, err := copyFile(db, userId, source, overwrite); !errors.As(err, &apiErr) || apiErr.Code != errQuotaExceeded.Code {
+		t.Fatalf("copy over the quota: got %v", err)
+	}
+	if trashed(t, db, target) {
+		t.Error("failed copy trashed the target")
+	}
+
+	// A move that fails
+	if _, err := db.Exec(`CREATE TRIGGER fail_move BEFORE UPDATE OF folder_id ON files BEGIN SELECT RAISE(ABORT, 'move failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moveFile(db, userId, source, overwrite); err == nil {
+		t.Fatal("move succeeded")
+	}
+	if trashed(t, db, target) {
+		t.Error("failed move trashed the target")
+	}
+
+	// Once it works the target is trashed
+	if _, err := db.Exec(`DROP TRIGGER fail_move`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moveFile(db, userId, source, overwrite); err != nil {
+		t.Fatal(err)
+	}
+	if !trashed(t, db, target) || trashed(t, db, source) {
+		t.Error("move didnt replace the target")
+	}
+}
+
+func TestOverwriteFolderKeepsTargetOnFailure(t *testing.T) {
+	db, userId := setupUploads(t)
+	for _, path := range []string{"~/a", "~/b", "~/b/a"} {
+		if err := createFolder(db, path, userId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`CREATE TRIGGER fail_move BEFORE UPDATE OF name ON folders WHEN NEW.name = 'a' AND NEW.parent_id IS NOT NULL AND OLD.parent_id != NEW.parent_id BEGIN SELECT RAISE(ABORT, 'move failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moveFolder(db, userId, "~/a", MoveReq{Path: "~/b", Conflict: ConflictOverwrite}); err == nil {
+		t.Fatal("move succeeded")
+	}
+	if _, err := getFolderIdFromPath(db, "~/b/a", userId); err != nil {
+		t.Errorf("failed move trashed the target: %v", err)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC login is enabled when OIDC_ISSUER is set. Users are auto provisioned
+// only when OIDC_ALLOWED_GROUP is set and found in the groups claim.
+const (
+	OIDCStateValidMinutes = 10
+	OIDCClockSkewSeconds  = 60
+)
+
+var (
+	errOIDCDisabled     = &APIError{Status: http.StatusNotFound, Code: "oidc_disabled", Message: "Oidc login is disabled"}
+	errOIDCInvalidToken = errors.New("invalid id token")
+	errOIDCNotAllowed   = &APIError{Status: http.StatusForbidden, Code: "oidc_not_allowed", Message: "User is not allowed to sign in"}
+	errOIDCLinked       = &APIError{Status: http.StatusConflict, Code: "oidc_identity_linked", Message: "Identity is linked to a user already"}
+)
+
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"`
+	Scopes       string `yaml:"scopes"`
+	GroupsClaim  string `yaml:"groups_claim"`
+	AllowedGroup string `yaml:"allowed_group"`
+}
+
+type oidcProvider struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	Issuer                string `json:"issuer"`
+}
+
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	ExpiresAt         int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+}
+
+var (
+	OIDC           OIDCConfig
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+	oidcMu       sync.Mutex
+	oidcMetadata *oidcProvider
+	oidcKeys     map[string]*rsa.PublicKey
+)
+
+func (c OIDCConfig) enabled() bool {
+	return c.Issuer != "" && c.ClientID != "" && c.RedirectURL != ""
+}
+
+func getOIDCProvider() (*oidcProvider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcMetadata != nil {
+		return oidcMetadata, nil
+	}
+
+	// Fetch discovery document
+	resp, err := oidcHTTPClient.Get(OIDC.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery failed: %s", resp.Status)
+	}
+
+	var provider oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != OIDC.Issuer {
+		return nil, errors.New("oidc discovery issuer mismatch")
+	}
+
+	oidcMetadata = &provider
+	return oidcMetadata, nil
+}
+
+// getOIDCKey returns the signing key with kid, refetching the key set once
+// when the provider rotated its keys.
+func getOIDCKey(provider *oidcProvider, kid string) (*rsa.PublicKey, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if key, ok := oidcKeys[kid]; ok {
+		return key, nil
+	}
+
+	resp, err := oidcHTTPClient.Get(provider.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	oidcKeys = keys
+
+	key, ok := oidcKeys[kid]
+	if !ok {
+		return nil, errOIDCInvalidToken
+	}
+	return key, nil
+}
+
+// startOIDCLogin stores state, nonce and pkce verifier and returns the url the
+// browser is sent to. A non zero linkUserId links the identity to that user
+// instead of logging in.
+func startOIDCLogin(db *sql.DB, linkUserId int) (string, error) {
+	if !OIDC.enabled() {
+		return "", errOIDCDisabled
+	}
+	provider, err := getOIDCProvider()
+	if err != nil {
+		log.Printf("Couldnt get oidc provider: %s", err.Error())
+		return "", err
+	}
+
+	state := generateRawToken()
+	nonce := generateRawToken()
+	verifier := generateRawToken()
+	challenge := sha256.Sum256([]byte(verifier))
+
+	expiresAt := time.Now().Add(OIDCStateValidMinutes * time.Minute).UTC()
+	var linkUser sql.NullInt64
+	if linkUserId != 0 {
+		linkUser = sql.NullInt64{Int64: int64(linkUserId), Valid: true}
+	}
+	if _, err := db.Exec(`INSERT INTO oidc_states (state, nonce, code_verifier, link_user_id, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		hashToken(state), nonce, verifier, linkUser, expiresAt); err != nil {
+		log.Printf("Couldnt insert oidc state: %s", err.Error())
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", OIDC.ClientID)
+	query.Set("redirect_uri", OIDC.RedirectURL)
+	query.Set("scope", OIDC.Scopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// finishOIDCLogin redeems the authorization code and returns the local user
+// the identity belongs to.
+func finishOIDCLogin(db *sql.DB, state, code string) (int, error) {
+	if !OIDC.enabled() {
+		return 0, errOIDCDisabled
+	}
+	provider, err := getOIDCProvider()
+	if err != nil {
+		return 0, err
+	}
+
+	// Get and remove state, it can only be used once
+	var nonce, verifier string
+	var linkUser sql.NullInt64
+	if err := db.QueryRow(`SELECT nonce, code_verifier, link_user_id FROM oidc_states WHERE state = ? AND expires_at > ?`, hashToken(state), time.Now().UTC()).Scan(&nonce, &verifier, &linkUser); err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec(`DELETE FROM oidc_states WHERE state = ?`, hashToken(state)); err != nil {
+		return 0, err
+	}
+
+	// Exchange code
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", OIDC.RedirectURL)
+	form.Set("client_id", OIDC.ClientID)
+	form.Set("code_verifier", verifier)
+	if OIDC.ClientSecret != "" {
+		form.Set("client_secret", OIDC.ClientSecret)
+	}
+	resp, err := oidcHTTPClient.PostForm(provider.TokenEndpoint, form)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("oidc token exchange failed: %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return 0, err
+	}
+
+	// Verify id token
+	claims, rawClaims, err := verifyIDToken(provider, tokenResp.IDToken, nonce)
+	if err != nil {
+		return 0, err
+	}
+
+	// Link identity to a signed in user
+	if linkUser.Valid {
+		if err := linkOIDCIdentity(db, claims.Subject, linkUser.Int64); err != nil {
+			return 0, err
+		}
+		return int(linkUser.Int64), nil
+	}
+
+	return getOrProvisionOIDCUser(db, claims, rawClaims)
+}
+
+func verifyIDToken(provider *oidcProvider, idToken, nonce string) (oidcClaims, map[string]any, error) {
+	var claims oidcClaims
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, nil, errOIDCInvalidToken
+	}
+
+	// Check header and signature
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerBytes, &header) != nil || header.Alg != "RS256" {
+		return claims, nil, errOIDCInvalidToken
+	}
+	key, err := getOIDCKey(provider, header.Kid)
+	if err != nil {
+		return claims, nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, nil, errOIDCInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return claims, nil, errOIDCInvalidToken
+	}
+
+	// Check claims
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, nil, errOIDCInvalidToken
+	}
+	var rawClaims map[string]any
+	if json.Unmarshal(payload, &claims) != nil || json.Unmarshal(payload, &rawClaims) != nil {
+		return claims, nil, errOIDCInvalidToken
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != OIDC.Issuer || claims.Subject == "" || claims.Nonce != nonce {
+		return claims, nil, errOIDCInvalidToken
+	}
+	if time.Now().Unix() > claims.ExpiresAt+OIDCClockSkewSeconds {
+		return claims, nil, errOIDCInvalidToken
+	}
+	if !audienceContains(claims.Audience, OIDC.ClientID) {
+		return claims, nil, errOIDCInvalidToken
+	}
+
+	return claims, rawClaims, nil
+}
+
+func audienceContains(aud json.RawMessage, clientId string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == clientId
+	}
+	var many []string
+	if json.Unmarshal(aud, &many) == nil {
+		for _, a := range many {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func claimHasGroup(rawClaims map[string]any, claim, group string) bool {
+	switch groups := rawClaims[claim].(type) {
+	case string:
+		return groups == group
+	case []any:
+		for _, g := range groups {
+			if s, ok := g.(string); ok && s == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getOrProvisionOIDCUser(db *sql.DB, claims oidcClaims, rawClaims map[string]any) (int, error) {
+	// Known identity
+	var userId int
+	var disabled bool
+	err := db.QueryRow(`SELECT i.user_id, u.disabled FROM user_identities i JOIN users u ON u.id = i.user_id WHERE i.issuer = ? AND i.subject = ?`, OIDC.Issuer, claims.Subject).Scan(&userId, &disabled)
+	if err == nil {
+		if disabled {
+			return 0, errOIDCNotAllowed
+		}
+		return userId, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	// Unknown identities are only provisioned for the allowed group
+	if OIDC.AllowedGroup == "" || !claimHasGroup(rawClaims, OIDC.GroupsClaim, OIDC.AllowedGroup) {
+		return 0, errOIDCNotAllowed
+	}
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Email
+	}
+	if username == "" {
+		username = claims.Subject
+	}
+
+	// The user signs in through the provider, the local password is unusable
+	passwordHash, err := hashPassword(generateRawToken())
+	if err != nil {
+		return 0, err
+	}
+	// User and identity are created together, a failed link leaves no user
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	newUserId, err := insertUser(tx, username, passwordHash, "user", Conf.DefaultQuotaBytes)
+	if err != nil {
+		log.Printf("Couldnt provision oidc user %s: %s", username, err.Error())
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO user_identities (issuer, subject, user_id) VALUES (?, ?, ?)`, OIDC.Issuer, claims.Subject, newUserId); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return int(newUserId), nil
+}
+
+// linkOIDCIdentity links an identity to a user that still exists and isnt
+// disabled.
+func linkOIDCIdentity(db *sql.DB, subject string, userId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var disabled bool
+	if err := tx.QueryRow(`SELECT disabled FROM users WHERE id = ?`, userId).Scan(&disabled); err != nil {
+		if err == sql.ErrNoRows {
+			return errOIDCNotAllowed
+		}
+		return err
+	}
+	if disabled {
+		return errOIDCNotAllowed
+	}
+	_, err = tx.Exec(`INSERT INTO user_identities (issuer, subject, user_id) VALUES (?, ?, ?)`, OIDC.Issuer, subject, userId)
+	if isUniqueViolation(err) {
+		return errOIDCLinked
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOIDCProvider serves discovery, a key set and a token endpoint that
+// answers every code with the next id token.
+type testOIDCProvider struct {
+	server  *httptest.Server
+	key     *rsa.PrivateKey
+	idToken string
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testOIDCProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "test",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") == "" || r.FormValue("code_verifier") == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	// Point the config at the provider and drop cached metadata and keys
+	prevOIDC := OIDC
+	OIDC = OIDCConfig{
+		Issuer:       p.server.URL,
+		ClientID:     "drive",
+		RedirectURL:  "http://drive.test/api/oidc/callback",
+		Scopes:       "openid",
+		GroupsClaim:  "groups",
+		AllowedGroup: "drive-users",
+	}
+	resetCache := func() {
+		oidcMu.Lock()
+		oidcMetadata, oidcKeys = nil, nil
+		oidcMu.Unlock()
+	}
+	resetCache()
+	t.Cleanup(func() {
+		OIDC = prevOIDC
+		resetCache()
+	})
+	return p
+}
+
+// sign returns an RS256 id token for claims, signed with key.
+func (p *testOIDCProvider) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login starts a login, lets edit change the default claims and finishes it
+// with a token signed by key.
+func (p *testOIDCProvider) login(t *testing.T, key *rsa.PrivateKey, edit func(map[string]any)) (int, error) {
+	t.Helper()
+	authURL, err := startOIDCLogin(DB, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+
+	claims := map[string]any{
+		"iss":                p.server.URL,
+		"sub":                "subject-1",
+		"aud":                "drive",
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+		"nonce":              query.Get("nonce"),
+		"preferred_username": "oidcuser",
+		"groups":             []string{"staff", "drive-users"},
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	p.idToken = p.sign(t, key, claims)
+	return finishOIDCLogin(DB, query.Get("state"), "code")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	db := openTestDB(t)
+	p := newTestOIDCProvider(t)
+
+	userId, err := p.login(t, p.key, nil)
+	if err != nil {
+		t.Fatalf("valid login: %v", err)
+	}
+	var username string
+	if err := db.QueryRow(`SELECT username FROM users WHERE id = ?`, userId).Scan(&username); err != nil {
+		t.Fatal(err)
+	}
+	if username != "oidcuser" {
+		t.Errorf("provisioned username %q, want oidcuser", username)
+	}
+
+	// Second login finds the identity
+	again, err := p.login(t, p.key, nil)
+	if err != nil || again != userId {
+		t.Errorf("second login: got user %d, %v, want %d", again, err, userId)
+	}
+}
+
+func TestOIDCLoginRejectsBadTokens(t *testing.T) {
+	openTestDB(t)
+	p := newTestOIDCProvider(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  *rsa.PrivateKey
+		edit func(map[string]any)
+		want error
+	}{
+		{"bad signature", otherKey, nil, errOIDCInvalidToken},
+		{"wrong audience", p.key, func(c map[string]any) { c["aud"] = "other" }, errOIDCInvalidToken},
+		{"wrong audience list", p.key, func(c map[string]any) { c["aud"] = []string{"other", "another"} }, errOIDCInvalidToken},
+		{"wrong issuer", p.key, func(c map[string]any) { c["iss"] = "https://evil.test" }, errOIDCInvalidToken},
+		{"expired", p.key, func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, errOIDCInvalidToken},
+		{"nonce mismatch", p.key, func(c map[string]any) { c["nonce"] = "other" }, errOIDCInvalidToken},
+		{"missing group", p.key, func(c map[string]any) { c["groups"] = []string{"staff"} }, errOIDCNotAllowed},
+		{"missing groups claim", p.key, func(c map[string]any) { delete(c, "groups") }, errOIDCNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.login(t, tt.key, tt.edit); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Nothing was provisioned
+	var count int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM user_identities`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d identities after rejected logins", count)
+	}
+}
+
+func TestOIDCStateIsSingleUse(t *testing.T) {
+	openTestDB(t)
+	p := newTestOIDCProvider(t)
+
+	authURL, err := startOIDCLogin(DB, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := url.Parse(authURL)
+	query := parsed.Query()
+	p.idToken = p.sign(t, p.key, map[string]any{
+		"iss": p.server.URL, "sub": "subject-1", "aud": "drive",
+		"exp": time.Now().Add(time.Minute).Unix(), "nonce": query.Get("nonce"),
+		"groups": "drive-users",
+	})
+	if _, err := finishOIDCLogin(DB, query.Get("state"), "code"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := finishOIDCLogin(DB, query.Get("state"), "code"); err == nil {
+		t.Error("state was accepted twice")
+	}
+	if !strings.HasPrefix(authURL, p.server.URL+"/authorize?") {
+		t.Errorf("auth url %s", authURL)
+	}
+}
+
+func TestOIDCLink(t *testing.T) {
+	db := openTestDB(t)
+	p := newTestOIDCProvider(t)
+
+	first, err := insertUser(db, "first", "x", "user", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := insertUser(db, "second", "x", "user", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := func(userId int64) (int, error) {
+		authURL, err := startOIDCLogin(db, int(userId))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, _ := url.Parse(authURL)
+		query := parsed.Query()
+		p.idToken = p.sign(t, p.key, map[string]any{
+			"iss": p.server.URL, "sub": "subject-1", "aud": "drive",
+			"exp": time.Now().Add(time.Minute).Unix(), "nonce": query.Get("nonce"),
+		})
+		return finishOIDCLogin(db, query.Get("state"), "code")
+	}
+
+	if got, err := link(first); err != nil || got != int(first) {
+		t.Fatalf("link: got %d, %v", got, err)
+	}
+	if _, err := link(second); err != errOIDCLinked {
+		t.Errorf("linking a linked identity: got %v, want errOIDCLinked", err)
+	}
+
+	// A user that is disabled while the login is in flight isnt linked
+	if _, err := db.Exec(`UPDATE users SET disabled = 1 WHERE id = ?`, second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DELETE FROM user_identities`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := link(second); err != errOIDCNotAllowed {
+		t.Errorf("linking a disabled user: got %v, want errOIDCNotAllowed", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters used for new hashes. Stored hashes carry their own
+// parameters, so raising these only affects hashes created afterwards.
+const (
+	Argon2Memory  uint32 = 64 * 1024
+	Argon2Time    uint32 = 3
+	Argon2Threads uint8  = 2
+	Argon2SaltLen        = 16
+	Argon2KeyLen  uint32 = 32
+)
+
+// Limits for parameters of stored hashes, a damaged row mustnt crash or
+// stall a login
+const (
+	Argon2MaxMemory uint32 = 1024 * 1024
+	Argon2MaxTime   uint32 = 16
+	Argon2MinKeyLen        = 16
+	Argon2MaxKeyLen        = 64
+)
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// dummyPasswordHash is verified against when a login names an unknown user,
+// so the answer takes as long as for a wrong password.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := hashPassword(generateRawToken())
+	return hash
+})
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	keyLen  uint32
+}
+
+// hashPassword returns the password as a PHC formatted argon2id string:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, Argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, Argon2Time, Argon2Memory, Argon2Threads, Argon2KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, Argon2Memory, Argon2Time, Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword checks password against a stored value. Values that are not
+// argon2id hashes are legacy plaintext rows; they are compared in constant time
+// and reported as needing a rehash, as are hashes with outdated parameters.
+func verifyPassword(password, stored string) (ok bool, needsRehash bool) {
+	if !isPasswordHash(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(password), []byte(stored)) == 1
+		return ok, ok
+	}
+
+	params, salt, key, err := decodePasswordHash(stored)
+	if err != nil {
+		return false, false
+	}
+
+	otherKey := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+		return false, false
+	}
+
+	outdated := params.memory != Argon2Memory || params.time != Argon2Time ||
+		params.threads != Argon2Threads || params.keyLen != Argon2KeyLen
+	return true, outdated
+}
+
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$argon2id$")
+}
+
+func decodePasswordHash(stored string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errInvalidHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, errInvalidHash
+	}
+	if params.time < 1 || params.time > Argon2MaxTime || params.threads < 1 ||
+		params.memory < 8*uint32(params.threads) || params.memory > Argon2MaxMemory {
+		return params, nil, nil, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) < Argon2MinKeyLen || len(key) > Argon2MaxKeyLen {
+		return params, nil, nil, errInvalidHash
+	}
+	params.keyLen = uint32(len(key))
+
+	return params, salt, key, nil
+}
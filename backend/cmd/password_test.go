@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestVerifyPasswordRejectsBadParameters(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := verifyPassword("secret", hash); !ok {
+		t.Fatal("password of a fresh hash doesnt verify")
+	}
+
+	// salt and a 32 byte key, only the parameters change
+	tail := "$c2FsdHNhbHRzYWx0c2FsdA$" + "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	for _, params := range []string{"m=65536,t=0,p=2", "m=65536,t=3,p=0", "m=4,t=3,p=2", "m=4294967295,t=3,p=2", "m=65536,t=100,p=2"} {
+		if ok, _ := verifyPassword("secret", "$argon2id$v=19$"+params+tail); ok {
+			t.Errorf("%s verified", params)
+		}
+		if _, _, _, err := decodePasswordHash("$argon2id$v=19$" + params + tail); err != errInvalidHash {
+			t.Errorf("%s: got %v, want errInvalidHash", params, err)
+		}
+	}
+
+	// keys shorter than 16 or longer than 64 bytes
+	for _, key := range []string{"AAAA", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"} {
+		if _, _, _, err := decodePasswordHash("$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$" + key); err != errInvalidHash {
+			t.Errorf("key of %d chars: got %v", len(key), err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// authorizeFolder checks that p may use scope on the folder at path. Paths
+// start at the callers own root folder, so there is no owner to check.
+func authorizeFolder(p *Principal, scope, path string) error {
+	if !p.allows(scope, path) {
+		return errInsufficientScope
+	}
+	return nil
+}
+
+// authorizeFile checks that p may use scope on the file uuid. Files of other
+// users are reported as notFound, so uuids cant be probed.
+func authorizeFile(db *sql.DB, p *Principal, uuid, scope string, notFound error) error {
+	if !p.hasScope(scope) {
+		return errInsufficientScope
+	}
+
+	// Get owner and folder of the file, trashed files are only reachable
+	// through the trash
+	var ownerId, folderId int
+	err := db.QueryRow(`SELECT owner_id, folder_id FROM files WHERE uuid = ? AND deleted_at IS NULL`, uuid).Scan(&ownerId, &folderId)
+	if err == sql.ErrNoRows || (err == nil && ownerId != p.UserID) {
+		return notFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// The folder may be in the trash, personal access tokens may be limited
+	// to a folder
+	path, err := getFolderPathFromId(db, folderId)
+	if err == errFolderNotFound {
+		return notFound
+	}
+	if err != nil {
+		return err
+	}
+	return authorizeFolder(p, scope, path)
+}
+
+// folderAccess runs authorizeFolder for the {path} of a route.
+func folderAccess(scope string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := authorizeFolder(principalFrom(r), scope, r.PathValue("path")); err != nil {
+				writeError(w, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// fileAccess runs authorizeFile for the {uuid} of a route.
+func fileAccess(scope string, notFound error) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := authorizeFile(DB, principalFrom(r), r.PathValue("uuid"), scope, notFound); err != nil {
+				writeError(w, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Middleware wraps a handler, e.g. to check auth before it runs.
+type Middleware func(http.Handler) http.Handler
+
+// Router registers method specific routes on a ServeMux. Patterns can name
+// path parameters like /api/storage/file/{uuid}, handlers read them with
+// r.PathValue. Unknown paths get 404, known paths with another method 405
+// and an Allow header.
+type Router struct {
+	mux   *http.ServeMux
+	chain []Middleware
+}
+
+func newRouter() *Router {
+	return &Router{mux: http.NewServeMux()}
+}
+
+// With returns a router that registers on the same mux, wrapping its
+// routes in the given middleware after the ones of rt.
+func (rt *Router) With(middleware ...Middleware) *Router {
+	return &Router{mux: rt.mux, chain: append(slices.Clip(rt.chain), middleware...)}
+}
+
+func (rt *Router) Handle(method, pattern string, handler http.HandlerFunc) {
+	rt.mux.Handle(method+" "+pattern, chain(handler, rt.chain...))
+}
+
+// Handler returns the router wrapped in middleware that runs for every
+// request, including the ones that dont match a route.
+func (rt *Router) Handler(middleware ...Middleware) http.Handler {
+	return chain(http.HandlerFunc(rt.serve), middleware...)
+}
+
+// serve answers requests without a route with a json 404 or 405, the mux
+// itself only writes plain text.
+func (rt *Router) serve(w http.ResponseWriter, r *http.Request) {
+	h, pattern := rt.mux.Handler(r)
+	if pattern != "" {
+		rt.mux.ServeHTTP(w, r)
+		return
+	}
+
+	// Let the mux decide, it knows the allowed methods
+	rec := &discardWriter{header: make(http.Header)}
+	h.ServeHTTP(rec, r)
+	switch rec.status {
+	case http.StatusNotFound:
+		writeError(w, errNotFound)
+	case http.StatusMethodNotAllowed:
+		w.Header().Set("Allow", rec.header.Get("Allow"))
+		writeError(w, errMethodNotAllowed)
+	default:
+		// e.g. redirects to the cleaned path
+		h.ServeHTTP(w, r)
+	}
+}
+
+// discardWriter only keeps the header and status a handler wrote.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(status int)      { d.status = status }
+
+// chain wraps h so the first middleware runs first.
+func chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "*")
+
+		// Preflight request
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+// principalFrom returns the caller resolved by authenticate.
+func principalFrom(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey).(*Principal)
+	return p
+}
+
+// headerToken reads the auth token of a request from its header.
+func headerToken(r *http.Request) string {
+	return r.Header.Get("Authorization")
+}
+
+// downloadToken reads the auth token of a download. Browsers cant set headers
+// on download links, so GET requests may pass it as ?auth= instead.
+func downloadToken(r *http.Request) string {
+	if token := headerToken(r); token != "" {
+		return token
+	}
+	if r.Method == http.MethodGet {
+		return r.URL.Query().Get("auth")
+	}
+	return ""
+}
+
+// authenticate resolves the caller and stores it in the request context,
+// requests without valid credentials get a 401.
+func authenticate(next http.Handler) http.Handler {
+	return authenticateWith(headerToken, next)
+}
+
+// authenticateDownload is authenticate for download links, which may pass
+// the token in the query. Other routes dont take it from there, query strings
+// end up in logs and browser history.
+func authenticateDownload(next http.Handler) http.Handler {
+	return authenticateWith(downloadToken, next)
+}
+
+func authenticateWith(authToken func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := authToken(r)
+		if token == "" {
+			writeError(w, errUnauthorized)
+			return
+		}
+		p, err := resolvePrincipal(DB, token)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Couldnt resolve auth token: %s", err.Error())
+			}
+			writeError(w, errUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
+
+// requireScope lets only callers with scope through, it runs after
+// authenticate.
+func requireScope(scope string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !principalFrom(r).hasScope(scope) {
+				writeError(w, errInsufficientScope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireAdmin lets only admin sessions through, it runs after authenticate.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !principalFrom(r).isAdmin() {
+			writeError(w, errForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestQueryAuthOnlyOnDownloads(t *testing.T) {
+	db := openTestDB(t)
+	prevConf := Conf
+	t.Cleanup(func() { Conf = prevConf })
+	Conf = defaultConfig()
+
+	userId, err := insertUser(db, "reader", "x", "user", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := createAuthToken(db, int(userId), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	rt := newRouter()
+	rt.With(authenticate).Handle("GET", "/api/users/me", ok)
+	rt.With(authenticateDownload).Handle("GET", "/api/storage/file/{uuid}", ok)
+	rt.With(authenticateDownload).Handle("POST", "/api/storage/file/{uuid}/copy", ok)
+	handler := rt.Handler()
+
+	for _, tc := range []struct {
+		method, path string
+		header       bool
+		status       int
+	}{
+		{"GET", "/api/users/me", true, http.StatusOK},
+		{"GET", "/api/users/me", false, http.StatusUnauthorized},
+		{"GET", "/api/storage/file/abc", true, http.StatusOK},
+		{"GET", "/api/storage/file/abc", false, http.StatusOK},
+		{"POST", "/api/storage/file/abc/copy", false, http.StatusUnauthorized},
+	} {
+		target := tc.path
+		if !tc.header {
+			target += "?auth=" + url.QueryEscape(token.Token)
+		}
+		req := httptest.NewRequest(tc.method, target, nil)
+		if tc.header {
+			req.Header.Set("Authorization", token.Token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s %s header=%v: got %d, want %d", tc.method, tc.path, tc.header, rec.Code, tc.status)
+		}
+	}
+}
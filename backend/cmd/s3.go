@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3MinPartSize is the smallest part S3 accepts in a multipart upload, only
+// the last part may be smaller
+const S3MinPartSize = 5 << 20
+
+// S3Store keeps blobs in a bucket of an S3 compatible service, requests are
+// signed with AWS signature version 4. Unfinished uploads stay in a local
+// directory, clients send chunks smaller than an S3 part, and are uploaded
+// when they are finalized.
+type S3Store struct {
+	endpoint *url.URL
+	conf     S3Config
+	client   *http.Client
+	staging  *LocalStore
+	now      func() time.Time
+}
+
+// s3Error is an error response of S3.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && (e.Status == http.StatusNotFound || e.Code == "NoSuchKey")
+}
+
+func newS3Store(conf S3Config, staging *LocalStore) (*S3Store, error) {
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", conf.Endpoint)
+	}
+	if conf.Bucket == "" || conf.Region == "" {
+		return nil, errors.New("s3 storage needs a bucket and region")
+	}
+	return &S3Store{
+		endpoint: endpoint,
+		conf:     conf,
+		client:   &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: time.Minute}},
+		staging:  staging,
+		now:      time.Now,
+	}, nil
+}
+
+// objectURL returns the url of a key, in the path or as a subdomain.
+func (s *S3Store) objectURL(name string, query url.Values) *url.URL {
+	u := *s.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	if s.conf.PathStyle {
+		base += "/" + s.conf.Bucket
+	} else {
+		u.Host = s.conf.Bucket + "." + u.Host
+	}
+	key := s.conf.Prefix + name
+	u.Path = base + "/" + key
+	u.RawPath = s3Escape(base, false) + "/" + s3Escape(key, false)
+	u.RawQuery = s3Query(query)
+	return &u
+}
+
+// do sends a signed request and returns the response if it succeeded.
+func (s *S3Store) do(method, name string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	if body != nil && size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, s.objectURL(name, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		return nil, readS3Error(res)
+	}
+	return res, nil
+}
+
+func readS3Error(res *http.Response) error {
+	e := &s3Error{Status: res.StatusCode}
+	content, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if xml.Unmarshal(content, e) != nil || e.Code == "" {
+		e.Code = http.StatusText(res.StatusCode)
+	}
+	return e
+}
+
+// sign adds the signature version 4 authorization header. The payload isnt
+// hashed, the connection protects it.
+func (s *S3Store) sign(req *http.Request) {
+	now := s.now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD\n" +
+		"x-amz-date:" + now.Format("20060102T150405Z") + "\n"
+	signature := s.signature(now, req.Method, req.URL, canonicalHeaders, signedHeaders)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.conf.AccessKeyID+"/"+s.scope(now)+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func (s *S3Store) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.conf.Region + "/s3/aws4_request"
+}
+
+func (s *S3Store) signature(t time.Time, method string, u *url.URL, canonicalHeaders, signedHeaders string) string {
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		s3Query(u.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + s.scope(t) + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.conf.SecretAccessKey)
+	for _, part := range []string{t.Format("20060102"), s.conf.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes like signature version 4 expects, slashes are kept in
+// keys.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query returns the canonical query, sorted and escaped.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (s *S3Store) Put(name string, r io.Reader, size int64) error {
+	if isUpload(name) {
+		return s.staging.Put(name, r, size)
+	}
+	if size <= s.conf.PartSize {
+		res, err := s.do(http.MethodPut, name, nil, nil, r, size)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+	return s.putMultipart(name, r, size)
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads r in parts of the configured size. A failed upload is
+// aborted, so its parts dont use space in the bucket.
+func (s *S3Store) putMultipart(name string, r io.Reader, size int64) error {
+	// Start upload
+	res, err := s.do(http.MethodPost, name, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := s.uploadParts(name, created.UploadID, r, size); err != nil {
+		if res, errAbort := s.do(http.MethodDelete, name, url.Values{"uploadId": {created.UploadID}}, nil, nil, 0); errAbort == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *S3Store) uploadParts(name, uploadId string, r io.Reader, size int64) error {
+	// Send parts
+	parts := make([]s3Part, 0, size/s.conf.PartSize+1)
+	buf := make([]byte, s.conf.PartSize)
+	for sent := int64(0); sent < size; {
+		n, err := io.ReadFull(r, buf[:min(s.conf.PartSize, size-sent)])
+		if err != nil {
+			return err
+		}
+		number := len(parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}}
+		res, err := s.do(http.MethodPut, name, query, nil, bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		parts = append(parts, s3Part{PartNumber: number, ETag: res.Header.Get("ETag")})
+		sent += int64(n)
+	}
+
+	// Complete upload, errors can come with status 200
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	res, err := s.do(http.MethodPost, name, url.Values{"uploadId": {uploadId}}, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	content, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(content, []byte("<Error>")) {
+		e := &s3Error{Status: res.StatusCode}
+		xml.Unmarshal(content, e)
+		return e
+	}
+	return nil
+}
+
+func (s *S3Store) Append(name string, offset int64, r io.Reader) (int64, error) {
+	return s.staging.Append(name, offset, r)
+}
+
+func (s *S3Store) Finalize(upload, name string) error {
+	if err := s.putFile(name, s.staging.path(upload)); err != nil {
+		return err
+	}
+	return s.staging.Delete(upload)
+}
+
+func (s *S3Store) putFile(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return s.Put(name, f, fi.Size())
+}
+
+func (s *S3Store) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	if isUpload(name) {
+		return s.staging.Get(name, offset, length)
+	}
+
+	// Ask for the range only
+	header := http.Header{}
+	switch {
+	case length == 0:
+		return io.NopCloser(strings.NewReader("")), nil
+	case length > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := s.do(http.MethodGet, name, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *S3Store) Delete(name string) error {
+	if isUpload(name) {
+		return s.staging.Delete(name)
+	}
+	res, err := s.do(http.MethodDelete, name, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Stat(name string) (BlobInfo, error) {
+	if isUpload(name) {
+		return s.staging.Stat(name)
+	}
+	res, err := s.do(http.MethodHead, name, nil, nil, nil, 0)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	res.Body.Close()
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return BlobInfo{Size: res.ContentLength, ModTime: modTime}, nil
+}
+
+// SignedURL returns a presigned GET url of name that is valid for the
+// configured time, with the headers the download needs.
+func (s *S3Store) SignedURL(name, filename, mime string) (string, error) {
+	// Uploads are only in staging
+	if s.conf.PresignTTL <= 0 || isUpload(name) {
+		return "", nil
+	}
+	if mime == "" {
+		mime = "application/octet-stream"
+	}
+
+	now := s.now().UTC()
+	query := url.Values{
+		"X-Amz-Algorithm":              {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":             {s.conf.AccessKeyID + "/" + s.scope(now)},
+		"X-Amz-Date":                   {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":                {strconv.Itoa(int(s.conf.PresignTTL.Seconds()))},
+		"X-Amz-SignedHeaders":          {"host"},
+		"response-content-disposition": {"attachment; filename*=UTF-8''" + url.PathEscape(filename)},
+		"response-content-type":        {mime},
+	}
+	u := s.objectURL(name, query)
+	query.Set("X-Amz-Signature", s.signature(now, http.MethodGet, u, "host:"+u.Host+"\n", "host"))
+	u.RawQuery = s3Query(query)
+	return u.String(), nil
+}
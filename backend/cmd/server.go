@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"own_drive_backend/migrations"
+)
+
+const TokenCleanupInterval = time.Hour
+
+// inFlight counts requests that are still being handled, the db is only
+// closed after the last one returned.
+var inFlight sync.WaitGroup
+
+func trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startJobs runs the periodic maintenance jobs until ctx is cancelled.
+func startJobs(ctx context.Context) *sync.WaitGroup {
+	var jobs sync.WaitGroup
+	runEvery(ctx, &jobs, "clean tokens", TokenCleanupInterval, cleanTokens)
+	runEvery(ctx, &jobs, "collect blobs", BlobCollectInterval, collectBlobs)
+	runEvery(ctx, &jobs, "purge uploads", UploadPurgeInterval, purgeExpiredUploads)
+	if Conf.TrashRetention > 0 {
+		runEvery(ctx, &jobs, "purge trash", TrashPurgeInterval, purgeExpiredTrash)
+	}
+	return &jobs
+}
+
+func runEvery(ctx context.Context, jobs *sync.WaitGroup, name string, interval time.Duration, job func(*sql.DB) error) {
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := job(DB); err != nil {
+				log.Printf("Job %s failed: %s", name, err.Error())
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// cleanTokens removes expired or invalid tokens from the db.
+func cleanTokens(db *sql.DB) error {
+	_, err := db.Exec(migrations.CleanTokens)
+	return err
+}
+
+// startServers serves handler on Conf.Listen, with https if tls is configured, and
+// on the redirect address if one is set.
+func startServers(ctx context.Context, jobs *sync.WaitGroup, handler http.Handler) ([]*http.Server, error) {
+	srv := &http.Server{Addr: Conf.Listen}
+
+	if !Conf.TLS.enabled() {
+		srv.Handler = trackRequests(handler)
+		go serve(srv.ListenAndServe)
+		return []*http.Server{srv}, nil
+	}
+
+	// Certificate
+	if Conf.TLS.SelfSigned {
+		if err := ensureSelfSignedCert(Conf.TLS.Cert, Conf.TLS.Key); err != nil {
+			return nil, err
+		}
+	}
+	certs, err := newCertReloader(Conf.TLS.Cert, Conf.TLS.Key)
+	if err != nil {
+		return nil, err
+	}
+	certs.watch(ctx, jobs)
+
+	if Conf.TLS.HSTSMaxAge > 0 {
+		handler = hstsMiddleware(handler)
+	}
+	srv.Handler = trackRequests(handler)
+	srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+	go serve(func() error { return srv.ListenAndServeTLS("", "") })
+	log.Printf("Serving https on %s", Conf.Listen)
+	servers := []*http.Server{srv}
+
+	// Plain http only redirects
+	if Conf.TLS.RedirectListen != "" {
+		redirect := &http.Server{Addr: Conf.TLS.RedirectListen, Handler: http.HandlerFunc(redirectToHTTPS)}
+		go serve(redirect.ListenAndServe)
+		log.Printf("Redirecting http on %s to https", Conf.TLS.RedirectListen)
+		servers = append(servers, redirect)
+	}
+
+	return servers, nil
+}
+
+func serve(listen func() error) {
+	if err := listen(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// shutdownServers stops accepting connections and gives running requests
+// Conf.ShutdownTimeout to finish. Connections still open after that are
+// closed. Once every request and job returned the db is closed.
+func shutdownServers(jobs *sync.WaitGroup, servers ...*http.Server) {
+	log.Printf("Shutting down, waiting up to %s for running requests", Conf.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), Conf.ShutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Closing remaining connections: %s", err.Error())
+			srv.Close()
+		}
+	}
+
+	inFlight.Wait()
+	jobs.Wait()
+
+	log.Println("Closing db")
+	if err := DB.Close(); err != nil {
+		log.Printf("Couldnt close db: %s", err.Error())
+	}
+	log.Println("Server stopped")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+)
+
+func generateSessionId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func listSessions(db *sql.DB, userId int, currentToken string) ([]SessionWrapper, error) {
+	sessions := make([]SessionWrapper, 0)
+	currentTokenHash := hashToken(currentToken)
+
+	rows, err := db.Query(`SELECT token, session_id, created_at, last_used_at, COALESCE(refresh_expires_at, expires_at), user_agent, ip FROM auth_tokens WHERE user_id = ? ORDER BY created_at DESC`, userId)
+	if err != nil {
+		log.Printf("Couldnt get sessions: %s", err.Error())
+		return sessions, err
+	}
+	defer rows.Close()
+
+	// Turn sql rows into structs
+	for rows.Next() {
+		var s SessionWrapper
+		var token string
+		var createdAt, lastUsedAt, expiresAt, userAgent, ip sql.NullString
+		if err := rows.Scan(&token, &s.ID, &createdAt, &lastUsedAt, &expiresAt, &userAgent, &ip); err != nil {
+			log.Printf("Couldnt scan session rows: %s", err.Error())
+			return sessions, err
+		}
+
+		// Timestamps come back as text, the columns arent always declared as DATETIME
+		if t, ok := parseDBTime(createdAt.String); ok {
+			s.CreatedAt = &t
+		}
+		if t, ok := parseDBTime(lastUsedAt.String); ok {
+			s.LastUsedAt = &t
+		}
+		s.ExpiresAt, _ = parseDBTime(expiresAt.String)
+		s.UserAgent = userAgent.String
+		s.IP = ip.String
+		s.Current = token == currentTokenHash
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+func revokeSession(db *sql.DB, userId int, sessionId string) error {
+	result, err := db.Exec(`DELETE FROM auth_tokens WHERE session_id = ? AND user_id = ?`, sessionId, userId)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func revokeOtherSessions(db *sql.DB, userId int, currentToken string) error {
+	_, err := db.Exec(`DELETE FROM auth_tokens WHERE user_id = ? AND token != ?`, userId, hashToken(currentToken))
+	return err
+}
+
+func revokeAuthToken(db *sql.DB, authToken string) error {
+	_, err := db.Exec(`DELETE FROM auth_tokens WHERE token = ?`, hashToken(authToken))
+	return err
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage drivers
+const (
+	DriverLocal = "local"
+	DriverS3    = "s3"
+)
+
+// BlobStore keeps the stored content of files. Names are slash separated
+// keys like blobs/ab/abcd.., unfinished uploads end in .part. Missing content
+// is reported with an error wrapping fs.ErrNotExist.
+type BlobStore interface {
+	// Put stores size bytes of r as name, replacing what was there.
+	Put(name string, r io.Reader, size int64) error
+	// Append writes r to the upload name at offset, cutting off what was
+	// after it, and returns the number of bytes written.
+	Append(name string, offset int64, r io.Reader) (int64, error)
+	// Finalize makes the finished upload the content of name.
+	Finalize(upload, name string) error
+	// Get reads length bytes of name from offset, a negative length reads to
+	// the end.
+	Get(name string, offset, length int64) (io.ReadCloser, error)
+	Delete(name string) error
+	Stat(name string) (BlobInfo, error)
+}
+
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// URLSigner is a BlobStore clients can download from directly. SignedURL
+// returns an empty url if downloads should go through the server.
+type URLSigner interface {
+	SignedURL(name, filename, mime string) (string, error)
+}
+
+var Store BlobStore
+
+// openStore opens the store of a driver as configured, encrypted if master
+// keys are set.
+func openStore(driver string) (BlobStore, error) {
+	var store BlobStore
+	var err error
+	switch driver {
+	case DriverLocal:
+		store = &LocalStore{root: Conf.StorageRoot}
+	case DriverS3:
+		store, err = newS3Store(Conf.Storage.S3, &LocalStore{root: Conf.StorageRoot})
+	default:
+		err = fmt.Errorf("unknown storage driver %q", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := loadMasterKeys(Conf.Storage.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		// Encrypted blobs cant be read without their keys
+		var encrypted bool
+		if err := DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM blob_keys)`).Scan(&encrypted); err != nil {
+			return nil, err
+		}
+		if encrypted {
+			return nil, errors.New("blobs are encrypted, but no encryption key is set")
+		}
+		return store, nil
+	}
+	return &CryptStore{inner: store, db: DB, keys: keys}, nil
+}
+
+func isUpload(name string) bool {
+	return strings.HasSuffix(name, ".part")
+}
+
+// hashBlob returns the hex sha256 of the content of name.
+func hashBlob(store BlobStore, name string) (string, error) {
+	r, err := store.Get(name, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// LocalStore keeps blobs in a directory. Names of files stored under an
+// absolute path are used as they are, legacy relative names are turned into
+// keys by resolveLegacyNames at startup.
+type LocalStore struct {
+	root string
+}
+
+func (s *LocalStore) path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *LocalStore) Put(name string, r io.Reader, size int64) error {
+	// Write next to the target, so readers never see half a file
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	written, err := io.Copy(f, r)
+	if err == nil && written != size {
+		err = fmt.Errorf("put %s: got %d of %d bytes", name, written, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *LocalStore) Append(name string, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.path(name), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Cut off at offset then write
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(f, r)
+	if err != nil {
+		return written, err
+	}
+	return written, f.Sync()
+}
+
+func (s *LocalStore) Finalize(upload, name string) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(s.path(upload), path)
+}
+
+func (s *LocalStore) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (s *LocalStore) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *LocalStore) Stat(name string) (BlobInfo, error) {
+	fi, err := os.Stat(s.path(name))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// blobReader reads a blob for http.ServeContent. A read after a seek gets
+// the blob again from the new offset, so ranges dont read the whole blob.
+type blobReader struct {
+	store BlobStore
+	name  string
+	size  int64
+	pos   int64
+	body  io.ReadCloser
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		body, err := b.store.Get(b.name, b.pos, -1)
+		if err != nil {
+			return 0, err
+		}
+		b.body = body
+	}
+	n, err := b.body.Read(p)
+	b.pos += int64(n)
+	return n, err
+}
+
+func (b *blobReader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += b.pos
+	case io.SeekEnd:
+		pos += b.size
+	}
+	if pos < 0 {
+		return 0, errors.New("seek before start of blob")
+	}
+	if pos != b.pos && b.body != nil {
+		b.body.Close()
+		b.body = nil
+	}
+	b.pos = pos
+	return pos, nil
+}
+
+func (b *blobReader) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	return b.body.Close()
+}
+
+// migrateBlobs copies every blob from one store to another and gives blobs
+// stored under absolute paths a key. Blobs already in the target are kept,
+// so an interrupted migration can be run again.
+func migrateBlobs(db *sql.DB, from, to BlobStore, progress io.Writer) (int, error) {
+	// Encrypted blobs are copied as they are, their keys stay valid. Blobs
+	// bound to their name are encrypted again when they get a key.
+	rawFrom, rawTo := from, to
+	if s, ok := from.(*CryptStore); ok {
+		rawFrom = s.inner
+	}
+	if s, ok := to.(*CryptStore); ok {
+		rawTo = s.inner
+	}
+
+	storedNames, err := queryStrings(db, `SELECT stored_name FROM blobs ORDER BY stored_name`)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, name := range storedNames {
+		key, err := blobKey(name)
+		if err != nil {
+			return i, err
+		}
+		src, dst := rawFrom, rawTo
+		if key != name {
+			var bound bool
+			if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM blob_keys WHERE stored_name = ? AND bound)`, name).Scan(&bound); err != nil {
+				return i, err
+			}
+			if bound {
+				src, dst = from, to
+			}
+		}
+
+		// Copy unless it is there already
+		srcInfo, err := src.Stat(name)
+		if err != nil {
+			return i, fmt.Errorf("%s: %w", name, err)
+		}
+		if dstInfo, err := dst.Stat(key); err != nil || dstInfo.Size != srcInfo.Size {
+			r, err := src.Get(name, 0, -1)
+			if err != nil {
+				return i, fmt.Errorf("%s: %w", name, err)
+			}
+			err = dst.Put(key, r, srcInfo.Size)
+			r.Close()
+			if err != nil {
+				return i, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+
+		if key != name {
+			if err := renameBlob(db, name, key); err != nil {
+				return i, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		fmt.Fprintf(progress, "%d/%d %s\n", i+1, len(storedNames), key)
+	}
+	return len(storedNames), nil
+}
+
+// blobKey returns the key of a blob stored under an absolute path, other
+// names are keys already.
+func blobKey(name string) (string, error) {
+	if !filepath.IsAbs(name) {
+		return name, nil
+	}
+	rel, err := filepath.Rel(Conf.StorageRoot, name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is outside of the storage root", name)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// legacyStorageDir is where the first versions stored files, relative to the
+// working directory. Their stored names are paths like files/<uuid>.
+const legacyStorageDir = "files"
+
+// resolveLegacyNames renames files stored under legacy relative names to
+// their key below root. The names are resolved against the working
+// directory, like the first versions did. Files outside of root are moved
+// into it. Names that are keys already are left alone, so it can run on
+// every start.
+func resolveLegacyNames(db *sql.DB, root string) error {
+	names, err := queryStrings(db, `SELECT stored_name FROM blobs WHERE stored_name LIKE ?1
+		UNION SELECT stored_name FROM files WHERE stored_name LIKE ?1`, legacyStorageDir+"/%")
+	if err != nil {
+		return err
+	}
+
+	local := &LocalStore{root: root}
+	for _, name := range names {
+		// A key that only looks like a legacy name
+		if _, err := os.Stat(local.path(name)); err == nil {
+			continue
+		}
+
+		// Get the key, files outside of root keep their file name
+		old, err := filepath.Abs(filepath.FromSlash(name))
+		if err != nil {
+			return err
+		}
+		key := filepath.Base(old)
+		if rel, err := filepath.Rel(root, old); err == nil && !strings.HasPrefix(rel, "..") {
+			key = filepath.ToSlash(rel)
+		}
+
+		// Move it into root, unless an earlier start did
+		if _, err := os.Stat(local.path(key)); errors.Is(err, fs.ErrNotExist) {
+			if err := os.MkdirAll(filepath.Dir(local.path(key)), 0o755); err != nil {
+				return err
+			}
+			if err := os.Rename(old, local.path(key)); err != nil {
+				log.Printf("Couldnt resolve legacy file %s: %s", name, err.Error())
+				continue
+			}
+		}
+		if err := renameBlob(db, name, key); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Printf("Renamed legacy file %s to %s", name, key)
+	}
+	return nil
+}
+
+// renameBlob points a blob and everything using it to a new name. Keys bound
+// to the name cant follow it, the blob has to be encrypted again under the
+// new name first.
+func renameBlob(db *sql.DB, name, key string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var bound bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM blob_keys WHERE stored_name = ?1 AND bound) AND NOT EXISTS(SELECT 1 FROM blob_keys WHERE stored_name = ?2)`, name, key).Scan(&bound); err != nil {
+		return err
+	}
+	if bound {
+		return fmt.Errorf("the key of %s is bound to its name", name)
+	}
+
+	// Files count their references with triggers, versions never change so
+	// they are counted here
+	for _, query := range []string{
+		`INSERT INTO blobs (stored_name, sha256, size_bytes, refs, created_at) SELECT ?2, sha256, size_bytes, 0, created_at FROM blobs WHERE stored_name = ?1`,
+		`UPDATE files SET stored_name = ?2 WHERE stored_name = ?1`,
+		`UPDATE file_versions SET stored_name = ?2 WHERE stored_name = ?1`,
+		`UPDATE blobs SET refs = refs + (SELECT COUNT(*) FROM file_versions WHERE stored_name = ?2) WHERE stored_name = ?2`,
+		`DELETE FROM blobs WHERE stored_name = ?1`,
+		`DELETE FROM blob_keys WHERE stored_name = ?1 AND EXISTS (SELECT 1 FROM blob_keys WHERE stored_name = ?2)`,
+		`UPDATE blob_keys SET stored_name = ?2 WHERE stored_name = ?1`,
+	} {
+		if _, err := tx.Exec(query, name, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// removeStoredFile deletes a name from the store, failures are only logged.
+func removeStoredFile(name string) {
+	if err := Store.Delete(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Couldnt remove %s: %s", name, err.Error())
+	}
+}
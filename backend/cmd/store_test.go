@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveLegacyNames(t *testing.T) {
+	for _, tc := range []struct {
+		name, root string
+	}{
+		{"inside root", "files"},
+		{"outside root", "store"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db, userId := setupUploads(t)
+			dir := t.TempDir()
+			t.Chdir(dir)
+			root := filepath.Join(dir, tc.root)
+
+			// The first versions stored files relative to the working directory
+			if err := os.MkdirAll(filepath.Join(dir, "files"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			var folderId int
+			if err := db.QueryRow(`SELECT id FROM folders WHERE owner_id = ?`, userId).Scan(&folderId); err != nil {
+				t.Fatal(err)
+			}
+			for uuid, content := range map[string]string{"abc": "stored", "def.part": "uploading"} {
+				name := "files/" + uuid
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if !isUpload(name) {
+					if _, err := db.Exec(`INSERT INTO blobs (stored_name, sha256, size_bytes) VALUES (?, '', ?)`, name, len(content)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, err := db.Exec(`INSERT INTO files (uuid, owner_id, folder_id, stored_name, display_name, size_bytes, size_bytes_on_disk, sha256) VALUES (?, ?, ?, ?, ?, ?, ?, '')`,
+					strings.TrimSuffix(uuid, ".part"), userId, folderId, name, uuid, len(content), len(content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// They get keys below root, twice changes nothing
+			for i := 0; i < 2; i++ {
+				if err := resolveLegacyNames(db, root); err != nil {
+					t.Fatal(err)
+				}
+			}
+			names, err := queryStrings(db, `SELECT stored_name || ':' || COALESCE((SELECT refs FROM blobs WHERE stored_name = files.stored_name), '') FROM files ORDER BY uuid`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(names, ",") != "abc:1,def.part:" {
+				t.Fatalf("stored names: %v", names)
+			}
+			local := &LocalStore{root: root}
+			if got := readBlob(t, local, "abc", 0, -1); string(got) != "stored" {
+				t.Errorf("blob is %q", got)
+			}
+			if got := readBlob(t, local, "def.part", 0, -1); string(got) != "uploading" {
+				t.Errorf("upload is %q", got)
+			}
+		})
+	}
+}
@@ -7,9 +7,67 @@ type LoginReq struct {
 	Password string `json:"password"`
 }
 
+type MFAReq struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+type MFAChallengeWrapper struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+type TOTPCodeReq struct {
+	Code string `json:"code"`
+}
+
+type TOTPEnrollWrapper struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type RecoveryCodesWrapper struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type RefreshReq struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 type TokenWrapper struct {
-	Token     string `json:"token"`
-	ExpiresAt string `json:"expires_at"`
+	Token            string `json:"token"`
+	ExpiresAt        string `json:"expires_at"`
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	RefreshExpiresAt string `json:"refresh_expires_at,omitempty"`
+}
+
+type InviteReq struct {
+	Role       string     `json:"role"`
+	QuotaBytes *int64     `json:"quota_bytes"`
+	MaxUses    *int       `json:"max_uses"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	Username   string     `json:"username"`
+	Note       string     `json:"note"`
+}
+
+type InviteWrapper struct {
+	ID         string                    `json:"id"`
+	Token      string                    `json:"token,omitempty"`
+	ExpiresAt  string                    `json:"expires_at"`
+	Role       string                    `json:"role"`
+	QuotaBytes int64                     `json:"quota_bytes"`
+	MaxUses    int                       `json:"max_uses"`
+	Uses       int                       `json:"uses"`
+	Username   string                    `json:"username,omitempty"`
+	Note       string                    `json:"note,omitempty"`
+	RedeemedBy []InviteRedemptionWrapper `json:"redeemed_by"`
+}
+
+type InviteRedemptionWrapper struct {
+	UserID     int       `json:"user_id"`
+	Username   string    `json:"username"`
+	RedeemedAt time.Time `json:"redeemed_at"`
 }
 
 type FileWrapper struct {
@@ -26,6 +84,44 @@ type FolderWrapper struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+type FileVersion struct {
+	Version   int       `json:"version"`
+	Current   bool      `json:"current"`
+	SizeBytes int64     `json:"size_bytes"`
+	Sha256    string    `json:"sha256"`
+	Mime      string    `json:"mime,omitempty"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TrashItem struct {
+	Type      string     `json:"type"`
+	ID        string     `json:"id"`
+	OwnerID   int        `json:"-"`
+	Name      string     `json:"name"`
+	Path      string     `json:"path"`
+	SizeBytes int64      `json:"size_bytes"`
+	DeletedAt time.Time  `json:"deleted_at"`
+	PurgeAt   *time.Time `json:"purge_at,omitempty"`
+}
+
+type RestoreReq struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+}
+
+type MoveReq struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	Conflict string `json:"conflict"`
+}
+
+type MoveWrapper struct {
+	UUID string `json:"uuid,omitempty"`
+	Path string `json:"path"`
+	Name string `json:"name"`
+}
+
 type FolderContents struct {
 	Folders []FolderWrapper `json:"folders"`
 	Files   []FileWrapper   `json:"files"`
@@ -43,4 +139,80 @@ type UploadReq struct {
 	Mime       string `json:"mime"`
 	Size_bytes int64  `json:"size_bytes"`
 	Sha256     string `json:"sha256"`
+	// Set to upload a new version of an existing file
+	FileUUID string `json:"file_uuid"`
+}
+
+type UploadStatus struct {
+	UploadID  string     `json:"upload_id"`
+	Offset    int64      `json:"offset"`
+	SizeBytes int64      `json:"size_bytes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	State     string     `json:"state"`
+}
+
+type SessionWrapper struct {
+	ID         string     `json:"id"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"`
+}
+
+type PersonalTokenReq struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Path      string     `json:"path"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type PersonalTokenWrapper struct {
+	ID         string     `json:"id"`
+	Token      string     `json:"token,omitempty"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Path       string     `json:"path,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+type LoginAttemptWrapper struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+	Locked        bool       `json:"locked"`
+}
+
+type AdminUserWrapper struct {
+	ID          int        `json:"id"`
+	Username    string     `json:"username"`
+	Role        string     `json:"role"`
+	QuotaBytes  int64      `json:"quota_bytes"`
+	UsedBytes   int64      `json:"used_bytes"`
+	FileCount   int64      `json:"file_count"`
+	Disabled    bool       `json:"disabled"`
+	TOTPEnabled bool       `json:"totp_enabled"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+}
+
+type AdminUserPatchReq struct {
+	QuotaBytes *int64  `json:"quota_bytes"`
+	Role       *string `json:"role"`
+	Disabled   *bool   `json:"disabled"`
+	Password   *string `json:"password"`
+}
+
+type AuditFilter struct {
+	Actor    string
+	Action   string
+	Target   string
+	Result   string
+	From     time.Time
+	To       time.Time
+	BeforeID int64
+	Limit    int
 }
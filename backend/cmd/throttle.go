@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+// Failed attempts are counted per key. After LoginFreeAttempts failures every
+// further failure doubles the wait, up to LoginLockoutMinutes. Counters are
+// forgotten once LoginAttemptWindowMinutes pass without a failure.
+const (
+	LoginFreeAttempts         = 3
+	LoginBackoffBaseSeconds   = 1
+	LoginLockoutMinutes       = 15
+	LoginAttemptWindowMinutes = 60
+)
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+func userThrottleKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// reserveAttempt checks the keys and counts the attempt as failed in one
+// transaction, so parallel attempts cant all pass the check before a failure
+// is recorded. It returns how long the caller has to wait if a key is locked,
+// nothing is counted then. A successful attempt gives its reservation back
+// with releaseAttempt.
+func reserveAttempt(db *sql.DB, keys ...string) (time.Time, time.Duration) {
+	now := time.Now().UTC()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Couldnt check login attempts: %s", err.Error())
+		return now, 0
+	}
+	defer tx.Rollback()
+
+	var wait time.Duration
+	for _, key := range keys {
+		var lockedUntil sql.NullTime
+		if err := tx.QueryRow(`SELECT locked_until FROM login_attempts WHERE key = ?`, key).Scan(&lockedUntil); err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Couldnt check login attempts: %s", err.Error())
+			}
+			continue
+		}
+		if lockedUntil.Valid && lockedUntil.Time.After(now) && lockedUntil.Time.Sub(now) > wait {
+			wait = lockedUntil.Time.Sub(now)
+		}
+	}
+	if wait > 0 {
+		return now, wait
+	}
+
+	for _, key := range keys {
+		if err := countFailure(tx, key, now); err != nil {
+			log.Printf("Couldnt record login attempt: %s", err.Error())
+			return now, 0
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Couldnt record login attempt: %s", err.Error())
+	}
+	return now, 0
+}
+
+// releaseAttempt takes back the failure reserveAttempt counted at reservedAt.
+// A lock the reservation set is lifted, locks of later failures are kept.
+func releaseAttempt(db *sql.DB, reservedAt time.Time, keys ...string) {
+	for _, key := range keys {
+		if _, err := db.Exec(`UPDATE login_attempts SET failures = failures - 1, locked_until = CASE WHEN last_failure_at = ? THEN NULL ELSE locked_until END WHERE key = ? AND failures > 0`, reservedAt, key); err != nil {
+			log.Printf("Couldnt release login attempt: %s", err.Error())
+		}
+	}
+}
+
+func recordFailedAttempt(db *sql.DB, keys ...string) {
+	now := time.Now().UTC()
+	for _, key := range keys {
+		if err := countFailure(db, key, now); err != nil {
+			log.Printf("Couldnt record login attempt: %s", err.Error())
+		}
+	}
+}
+
+// countFailure adds a failure to key and locks it once the free attempts are
+// used up.
+func countFailure(db dbRowExecer, key string, now time.Time) error {
+	// Get previous failures
+	var failures int
+	var lastFailureAt time.Time
+	err := db.QueryRow(`SELECT failures, last_failure_at FROM login_attempts WHERE key = ?`, key).Scan(&failures, &lastFailureAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == sql.ErrNoRows || now.Sub(lastFailureAt) > LoginAttemptWindowMinutes*time.Minute {
+		failures = 0
+	}
+	failures++
+
+	// Back off exponentially once the free attempts are used up
+	var lockedUntil sql.NullTime
+	if failures > LoginFreeAttempts {
+		wait := LoginLockoutMinutes * time.Minute
+		if exp := failures - LoginFreeAttempts - 1; exp < 20 {
+			if backoff := LoginBackoffBaseSeconds * time.Second << exp; backoff < wait {
+				wait = backoff
+			}
+		}
+		lockedUntil = sql.NullTime{Time: now.Add(wait), Valid: true}
+	}
+
+	_, err = db.Exec(`INSERT INTO login_attempts (key, failures, last_failure_at, locked_until) VALUES (?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET failures = excluded.failures, last_failure_at = excluded.last_failure_at, locked_until = excluded.locked_until`,
+		key, failures, now, lockedUntil)
+	return err
+}
+
+// resetThrottle forgets the failures of the keys and returns how many keys
+// had any.
+func resetThrottle(db *sql.DB, keys ...string) (int64, error) {
+	var reset int64
+	for _, key := range keys {
+		res, err := db.Exec(`DELETE FROM login_attempts WHERE key = ?`, key)
+		if err != nil {
+			log.Printf("Couldnt reset login attempts: %s", err.Error())
+			return reset, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return reset, err
+		}
+		reset += n
+	}
+	return reset, nil
+}
+
+func listThrottles(db *sql.DB) ([]LoginAttemptWrapper, error) {
+	attempts := make([]LoginAttemptWrapper, 0)
+
+	rows, err := db.Query(`SELECT key, failures, last_failure_at, locked_until FROM login_attempts ORDER BY last_failure_at DESC`)
+	if err != nil {
+		log.Printf("Couldnt get login attempts: %s", err.Error())
+		return attempts, err
+	}
+	defer rows.Close()
+
+	// Turn sql rows into structs
+	now := time.Now().UTC()
+	for rows.Next() {
+		var a LoginAttemptWrapper
+		var lockedUntil sql.NullTime
+		if err := rows.Scan(&a.Key, &a.Failures, &a.LastFailureAt, &lockedUntil); err != nil {
+			log.Printf("Couldnt scan login attempt rows: %s", err.Error())
+			return attempts, err
+		}
+		if lockedUntil.Valid {
+			a.LockedUntil = &lockedUntil.Time
+			a.Locked = lockedUntil.Time.After(now)
+		}
+		attempts = append(attempts, a)
+	}
+
+	return attempts, rows.Err()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func attemptFailures(t *testing.T, key string) int {
+	t.Helper()
+	var failures int
+	DB.QueryRow(`SELECT failures FROM login_attempts WHERE key = ?`, key).Scan(&failures)
+	return failures
+}
+
+func TestReserveAttemptParallel(t *testing.T) {
+	openTestDB(t)
+	ipKey := ipThrottleKey("192.0.2.1")
+
+	// Only the free attempts and the one that locks get through
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, wait := reserveAttempt(DB, ipKey, userThrottleKey("victim")); wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != LoginFreeAttempts+1 {
+		t.Errorf("%d parallel attempts got through, want %d", allowed, LoginFreeAttempts+1)
+	}
+}
+
+func TestReleaseAttemptKeepsIPFailures(t *testing.T) {
+	openTestDB(t)
+	ipKey := ipThrottleKey("192.0.2.1")
+
+	// Failed guesses against other users
+	for _, name := range []string{"a", "b", "c"} {
+		if _, wait := reserveAttempt(DB, ipKey, userThrottleKey(name)); wait > 0 {
+			t.Fatalf("guess at %s locked", name)
+		}
+	}
+
+	// A login to the own account gives back only its own attempt
+	reservedAt, wait := reserveAttempt(DB, ipKey, userThrottleKey("attacker"))
+	if wait > 0 {
+		t.Fatal("own login locked")
+	}
+	resetThrottle(DB, userThrottleKey("attacker"))
+	releaseAttempt(DB, reservedAt, ipKey)
+	if got := attemptFailures(t, ipKey); got != 3 {
+		t.Errorf("ip has %d failures after a login, want 3", got)
+	}
+	if _, wait := reserveAttempt(DB, ipKey); wait > 0 {
+		t.Error("ip locked before its free attempts are used up")
+	}
+	if _, wait := reserveAttempt(DB, ipKey, userThrottleKey("d")); wait == 0 {
+		t.Error("ip not locked after its free attempts")
+	}
+}
+
+func TestReleaseAttemptLiftsOwnLock(t *testing.T) {
+	openTestDB(t)
+	key := userThrottleKey("user")
+	for i := 0; i < LoginFreeAttempts; i++ {
+		reserveAttempt(DB, key)
+	}
+
+	// The reservation locks the key, giving it back unlocks it
+	reservedAt, wait := reserveAttempt(DB, key)
+	if wait > 0 {
+		t.Fatal("attempt refused")
+	}
+	if _, wait := reserveAttempt(DB, key); wait == 0 {
+		t.Fatal("parallel attempt got through")
+	}
+	releaseAttempt(DB, reservedAt, key)
+	if _, wait := reserveAttempt(DB, key); wait > 0 {
+		t.Errorf("key still locked after release, wait %s", wait)
+	}
+}
+
+func TestResetThrottleCountsKeys(t *testing.T) {
+	openTestDB(t)
+	recordFailedAttempt(DB, userThrottleKey("user"))
+
+	if n, err := resetThrottle(DB, userThrottleKey("user"), userThrottleKey("other")); err != nil || n != 1 {
+		t.Errorf("reset: got %d, %v, want 1", n, err)
+	}
+	if n, err := resetThrottle(DB, userThrottleKey("user")); err != nil || n != 0 {
+		t.Errorf("reset again: got %d, %v, want 0", n, err)
+	}
+}
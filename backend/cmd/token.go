@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scopes limit what an auth token may do. Sessions have every scope,
+// personal access tokens only the ones they were created with and never
+// ScopeAccount.
+const (
+	ScopeAccount = "account"
+	ScopeRead    = "read"
+	ScopeUpload  = "upload"
+	ScopeWrite   = "write"
+
+	PersonalTokenPrefix = "pat_"
+)
+
+var errInsufficientScope = &APIError{Status: http.StatusForbidden, Code: "insufficient_scope", Message: "Token doesnt allow this"}
+
+func isValidTokenScope(scope string) bool {
+	return scope == ScopeRead || scope == ScopeUpload || scope == ScopeWrite
+}
+
+// pathInScope reports whether path lies in the folder subtree a token is
+// limited to. An empty limit allows every path.
+func pathInScope(path, limit string) bool {
+	if limit == "" {
+		return true
+	}
+	path = strings.TrimSuffix(path, "/")
+	return path == limit || strings.HasPrefix(path, limit+"/")
+}
+
+func createPersonalToken(db *sql.DB, userId int, tokenReq PersonalTokenReq) (PersonalTokenWrapper, error) {
+	var resp PersonalTokenWrapper
+
+	// Validate scopes and path
+	if tokenReq.Name == "" || len(tokenReq.Scopes) == 0 {
+		return resp, invalidRequest("name and scopes are required")
+	}
+	for _, scope := range tokenReq.Scopes {
+		if !isValidTokenScope(scope) {
+			return resp, invalidRequest("invalid scope: " + scope)
+		}
+	}
+	path := strings.TrimSuffix(tokenReq.Path, "/")
+	if path != "" {
+		if _, err := getFolderIdFromPath(db, path, userId); err != nil {
+			return resp, invalidRequest("invalid path")
+		}
+	}
+	if tokenReq.ExpiresAt != nil && tokenReq.ExpiresAt.Before(time.Now()) {
+		return resp, invalidRequest("expiry is in the past")
+	}
+
+	// Generate token
+	var token string
+	for {
+		token = PersonalTokenPrefix + generateRawToken()
+
+		// check if token already exists
+		var tokenExists bool
+		db.QueryRow("SELECT EXISTS(SELECT 1 FROM personal_access_tokens WHERE token=?)", hashToken(token)).Scan(&tokenExists)
+		if tokenExists {
+			continue
+		}
+
+		// break the loop if token is unique
+		break
+	}
+
+	// Insert token in db
+	now := time.Now().UTC()
+	var expiresAt sql.NullTime
+	if tokenReq.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: tokenReq.ExpiresAt.UTC(), Valid: true}
+	}
+	id := generateSessionId()
+	_, err := db.Exec(`INSERT INTO personal_access_tokens (id, token, user_id, name, scopes, path, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, hashToken(token), userId, tokenReq.Name, strings.Join(tokenReq.Scopes, ","), path, now, expiresAt)
+	if err != nil {
+		log.Printf("Could not insert personal access token: %s", err.Error())
+		return resp, err
+	}
+
+	// The raw token is only ever returned here
+	resp = PersonalTokenWrapper{
+		ID:        id,
+		Token:     token,
+		Name:      tokenReq.Name,
+		Scopes:    tokenReq.Scopes,
+		Path:      path,
+		CreatedAt: now,
+	}
+	if expiresAt.Valid {
+		resp.ExpiresAt = &expiresAt.Time
+	}
+	return resp, nil
+}
+
+func listPersonalTokens(db *sql.DB, userId int) ([]PersonalTokenWrapper, error) {
+	tokens := make([]PersonalTokenWrapper, 0)
+
+	rows, err := db.Query(`SELECT id, name, scopes, path, created_at, last_used_at, expires_at FROM personal_access_tokens WHERE user_id = ? ORDER BY created_at DESC`, userId)
+	if err != nil {
+		log.Printf("Couldnt get personal access tokens: %s", err.Error())
+		return tokens, err
+	}
+	defer rows.Close()
+
+	// Turn sql rows into structs
+	for rows.Next() {
+		var t PersonalTokenWrapper
+		var scopes string
+		var lastUsedAt, expiresAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Name, &scopes, &t.Path, &t.CreatedAt, &lastUsedAt, &expiresAt); err != nil {
+			log.Printf("Couldnt scan personal access token rows: %s", err.Error())
+			return tokens, err
+		}
+		t.Scopes = strings.Split(scopes, ",")
+		if lastUsedAt.Valid {
+			t.LastUsedAt = &lastUsedAt.Time
+		}
+		if expiresAt.Valid {
+			t.ExpiresAt = &expiresAt.Time
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens, rows.Err()
+}
+
+func revokePersonalToken(db *sql.DB, userId int, tokenId string) error {
+	result, err := db.Exec(`DELETE FROM personal_access_tokens WHERE id = ? AND user_id = ?`, tokenId, userId)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// resolvePersonalToken returns the caller of a personal access token, its
+// scopes are checked by the policy.
+func resolvePersonalToken(db *sql.DB, token string) (*Principal, error) {
+	now := time.Now().UTC()
+	tokenHash := hashToken(token)
+
+	p := &Principal{Token: token}
+	var scopes string
+	var lastUsed sql.NullTime
+	if err := db.QueryRow(`SELECT u.id, u.role, t.scopes, t.path, t.last_used_at FROM personal_access_tokens t JOIN users u ON u.id = t.user_id WHERE t.token = ? AND (t.expires_at IS NULL OR t.expires_at > ?) AND u.disabled = 0`, tokenHash, now).Scan(&p.UserID, &p.Role, &scopes, &p.Path, &lastUsed); err != nil {
+		return nil, err
+	}
+	p.Scopes = strings.Split(scopes, ",")
+
+	// Remember when the token was last used
+	if !lastUsed.Valid || now.Sub(lastUsed.Time) > LastUsedResolution {
+		if _, err := db.Exec(`UPDATE personal_access_tokens SET last_used_at = ? WHERE token = ?`, now, tokenHash); err != nil {
+			log.Printf("Couldnt update personal access token usage: %s", err.Error())
+		}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 parameters, the defaults every authenticator app understands
+const (
+	TOTPIssuer           = "OwnDrive"
+	TOTPPeriodSeconds    = 30
+	TOTPDigits           = 6
+	TOTPSkewSteps        = 1
+	TOTPSecretLen        = 20
+	RecoveryCodeCount    = 10
+	MFATokenValidMinutes = 5
+)
+
+var (
+	errInvalidTOTPCode    = &APIError{Status: http.StatusBadRequest, Code: "invalid_code", Message: "Invalid code"}
+	errTOTPNotEnrolled    = &APIError{Status: http.StatusConflict, Code: "2fa_not_enrolling", Message: "2fa is not being enrolled"}
+	errTOTPAlreadyEnabled = &APIError{Status: http.StatusConflict, Code: "2fa_enabled", Message: "2fa is already enabled"}
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code for a time step as described in RFC 4226.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod)
+}
+
+// matchTOTPCode returns the time step code belongs to, allowing for some
+// clock skew, or -1 if it doesnt match.
+func matchTOTPCode(secret []byte, code string, now time.Time) int64 {
+	current := now.Unix() / TOTPPeriodSeconds
+	for step := current - TOTPSkewSteps; step <= current+TOTPSkewSteps; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+func enrollTOTP(db *sql.DB, userId int) (TOTPEnrollWrapper, error) {
+	var resp TOTPEnrollWrapper
+
+	// Users with 2fa have to disable it first
+	var enabled bool
+	var username string
+	if err := db.QueryRow(`SELECT username, totp_enabled FROM users WHERE id = ?`, userId).Scan(&username, &enabled); err != nil {
+		return resp, err
+	}
+	if enabled {
+		return resp, errTOTPAlreadyEnabled
+	}
+
+	// Generate secret
+	secret := make([]byte, TOTPSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return resp, err
+	}
+	encodedSecret := totpEncoding.EncodeToString(secret)
+
+	// Store it until the user confirms it
+	if _, err := db.Exec(`UPDATE users SET totp_secret = ?, totp_enabled = 0, totp_last_step = 0 WHERE id = ?`, encodedSecret, userId); err != nil {
+		log.Printf("Couldnt store totp secret: %s", err.Error())
+		return resp, err
+	}
+
+	// Build otpauth uri
+	label := url.PathEscape(TOTPIssuer + ":" + username)
+	query := url.Values{}
+	query.Set("secret", encodedSecret)
+	query.Set("issuer", TOTPIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(TOTPDigits))
+	query.Set("period", fmt.Sprint(TOTPPeriodSeconds))
+
+	resp.Secret = encodedSecret
+	resp.URI = "otpauth://totp/" + label + "?" + query.Encode()
+	return resp, nil
+}
+
+func confirmTOTP(db *sql.DB, userId int, code string) ([]string, error) {
+	// Get pending secret
+	var secret sql.NullString
+	var enabled bool
+	if err := db.QueryRow(`SELECT totp_secret, totp_enabled FROM users WHERE id = ?`, userId).Scan(&secret, &enabled); err != nil {
+		return nil, err
+	}
+	if !secret.Valid || enabled {
+		return nil, errTOTPNotEnrolled
+	}
+
+	// Check code
+	if err := checkTOTPCode(db, userId, secret.String, code); err != nil {
+		return nil, err
+	}
+
+	// Enable 2fa and hand out recovery codes
+	if _, err := db.Exec(`UPDATE users SET totp_enabled = 1 WHERE id = ?`, userId); err != nil {
+		log.Printf("Couldnt enable totp: %s", err.Error())
+		return nil, err
+	}
+	return createRecoveryCodes(db, userId)
+}
+
+func disableTOTP(db *sql.DB, userId int) error {
+	if _, err := db.Exec(`UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE id = ?`, userId); err != nil {
+		return err
+	}
+	_, err := db.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userId)
+	return err
+}
+
+func isTOTPEnabled(db *sql.DB, userId int) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(`SELECT totp_enabled FROM users WHERE id = ?`, userId).Scan(&enabled)
+	return enabled, err
+}
+
+// checkTOTPCode checks a code against secret and remembers its time step so
+// the same code cant be used twice.
+func checkTOTPCode(db *sql.DB, userId int, encodedSecret, code string) error {
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil {
+		return err
+	}
+
+	step := matchTOTPCode(secret, strings.TrimSpace(code), time.Now())
+	if step < 0 {
+		return errInvalidTOTPCode
+	}
+
+	// Only accept steps newer than the last used one
+	result, err := db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, userId, step)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errInvalidTOTPCode
+	}
+	return nil
+}
+
+// verifySecondFactor accepts either a current totp code or an unused recovery code.
+func verifySecondFactor(db *sql.DB, userId int, code string) error {
+	var secret sql.NullString
+	if err := db.QueryRow(`SELECT totp_secret FROM users WHERE id = ? AND totp_enabled = 1`, userId).Scan(&secret); err != nil {
+		return err
+	}
+
+	if err := checkTOTPCode(db, userId, secret.String, code); err != errInvalidTOTPCode {
+		return err
+	}
+
+	// Fall back to recovery codes
+	result, err := db.Exec(`UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code = ? AND used_at IS NULL`,
+		time.Now().UTC(), userId, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errInvalidTOTPCode
+	}
+	return nil
+}
+
+func createRecoveryCodes(db *sql.DB, userId int) ([]string, error) {
+	// Old codes stop working
+	if _, err := db.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userId); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		// xxxx-xxxx-xxxx-xxxx, only the hash is stored
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))
+		code := raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		if _, err := db.Exec(`INSERT INTO recovery_codes (user_id, code) VALUES (?, ?)`, userId, hashToken(normalizeRecoveryCode(code))); err != nil {
+			log.Printf("Couldnt store recovery code: %s", err.Error())
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// createMFAToken issues a short lived token that proves the password step of
+// a login succeeded.
+func createMFAToken(db *sql.DB, userId int) (string, error) {
+	token := generateRawToken()
+	expiresAt := time.Now().Add(MFATokenValidMinutes * time.Minute).UTC()
+	if _, err := db.Exec(`INSERT INTO mfa_tokens (token, user_id, expires_at) VALUES (?, ?, ?)`, hashToken(token), userId, expiresAt); err != nil {
+		log.Printf("Couldnt insert mfa token: %s", err.Error())
+		return "", err
+	}
+	return token, nil
+}
+
+func getMFATokenUser(db *sql.DB, mfaToken string) (int, error) {
+	var userId int
+	err := db.QueryRow(`SELECT user_id FROM mfa_tokens WHERE token = ? AND expires_at > ?`, hashToken(mfaToken), time.Now().UTC()).Scan(&userId)
+	return userId, err
+}
+
+// redeemMFAToken checks the second login step and returns the user id. The
+// mfa token can only be redeemed once.
+func redeemMFAToken(db *sql.DB, mfaToken, code string) (int, error) {
+	userId, err := getMFATokenUser(db, mfaToken)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := verifySecondFactor(db, userId, code); err != nil {
+		return 0, err
+	}
+
+	if _, err := db.Exec(`DELETE FROM mfa_tokens WHERE token = ?`, hashToken(mfaToken)); err != nil {
+		return 0, err
+	}
+	return userId, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// TrashPurgeInterval is how often items past the trash retention are purged
+const TrashPurgeInterval = time.Hour
+
+// Kinds of trash items
+const (
+	TrashFile   = "file"
+	TrashFolder = "folder"
+)
+
+var (
+	errTrashItemNotFound = &APIError{Status: http.StatusNotFound, Code: "trash_item_not_found", Message: "Item is not in the trash"}
+	errRestoreConflict   = &APIError{Status: http.StatusConflict, Code: "restore_conflict", Message: "Folder is gone or the name is taken, choose another path"}
+	errTrashRoot         = invalidRequest("The root folder cant be deleted")
+)
+
+// folderTree selects the ids of a folder and the folders below it. Trashed
+// subfolders are detached, so they arent part of the tree.
+const folderTree = `WITH RECURSIVE tree(id) AS (SELECT CAST(? AS INTEGER) UNION ALL SELECT f.id FROM folders f JOIN tree ON f.parent_id = tree.id) `
+
+// trashItems lists files and folders in the trash as (kind, id, owner_id,
+// name, trashed_from, deleted_at, size_bytes). Folder sizes are added later.
+const trashItems = `SELECT kind, id, owner_id, name, trashed_from, deleted_at, size_bytes FROM (
+	SELECT 'file' AS kind, uuid AS id, owner_id, display_name AS name, trashed_from, deleted_at, size_bytes FROM files WHERE deleted_at IS NOT NULL
+	UNION ALL
+	SELECT 'folder', CAST(id AS TEXT), owner_id, name, trashed_from, deleted_at, 0 FROM folders WHERE deleted_at IS NOT NULL
+)`
+
+// trashFile moves a file to the trash, its quota stays used until it is purged.
+func trashFile(db dbRowExecer, userId int, uuid string) error {
+	path, err := getFilePath(db, uuid)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE files SET deleted_at = ?, trashed_from = ? WHERE uuid = ? AND owner_id = ?`, time.Now().UTC(), path, uuid, userId)
+	return err
+}
+
+// trashFolder moves a folder with everything in it to the trash.
+func trashFolder(db *sql.DB, folderPath string, ownerId int) error {
+	folderId, err := getFolderIdFromPath(db, folderPath, ownerId)
+	if err != nil {
+		return err
+	}
+	return trashFolderById(db, folderId)
+}
+
+func trashFolderById(db dbRowExecer, folderId int) error {
+	// Get the parent, it is where the folder is restored to
+	var parentId sql.NullInt64
+	if err := db.QueryRow(`SELECT parent_id FROM folders WHERE id = ?`, folderId).Scan(&parentId); err != nil {
+		return err
+	}
+	if !parentId.Valid {
+		return errTrashRoot
+	}
+	parentPath, err := getFolderPathFromId(db, int(parentId.Int64))
+	if err != nil {
+		return err
+	}
+
+	// Detach from the parent, so the name can be used again
+	_, err = db.Exec(`UPDATE folders SET parent_id = NULL, deleted_at = ?, trashed_from = ? WHERE id = ?`, time.Now().UTC(), parentPath, folderId)
+	return err
+}
+
+func queryTrash(db *sql.DB, condition string, args ...any) ([]TrashItem, error) {
+	items := make([]TrashItem, 0)
+
+	rows, err := db.Query(trashItems+` WHERE `+condition+` ORDER BY deleted_at DESC`, args...)
+	if err != nil {
+		log.Printf("Couldnt get trash: %s", err.Error())
+		return items, err
+	}
+	defer rows.Close()
+
+	// Turn sql rows into structs
+	for rows.Next() {
+		var item TrashItem
+		var path sql.NullString
+		var deletedAt string
+		if err := rows.Scan(&item.Type, &item.ID, &item.OwnerID, &item.Name, &path, &deletedAt, &item.SizeBytes); err != nil {
+			log.Printf("Couldnt scan trash rows: %s", err.Error())
+			return items, err
+		}
+		item.Path = path.String
+		item.DeletedAt, _ = parseDBTime(deletedAt)
+		if Conf.TrashRetention > 0 {
+			purgeAt := item.DeletedAt.Add(Conf.TrashRetention)
+			item.PurgeAt = &purgeAt
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return items, err
+	}
+	rows.Close()
+
+	// Folders take the space of everything below them
+	for i, item := range items {
+		if item.Type != TrashFolder {
+			continue
+		}
+		if err := db.QueryRow(folderTree+`SELECT COALESCE(SUM(size_bytes), 0) FROM files WHERE folder_id IN tree`, item.ID).Scan(&items[i].SizeBytes); err != nil {
+			return items, err
+		}
+	}
+
+	return items, nil
+}
+
+// listTrash returns the trash of a user, newest first.
+func listTrash(db *sql.DB, userId int) ([]TrashItem, error) {
+	return queryTrash(db, `owner_id = ?`, userId)
+}
+
+func getTrashItem(db *sql.DB, userId int, kind, id string) (TrashItem, error) {
+	items, err := queryTrash(db, `owner_id = ? AND kind = ? AND id = ?`, userId, kind, id)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if len(items) == 0 {
+		return TrashItem{}, errTrashItemNotFound
+	}
+	return items[0], nil
+}
+
+// restoreTrashItem moves an item out of the trash into the folder at path
+// under name. It fails with errRestoreConflict if the folder is gone or the
+// name is taken, the client can then choose another path.
+func restoreTrashItem(db *sql.DB, userId int, item TrashItem, path, name string) error {
+	// Get target folder
+	folderId, err := getFolderIdFromPath(db, path, userId)
+	if err == errFolderNotFound && path == item.Path {
+		return errRestoreConflict.withDetails(map[string]any{"path": path})
+	}
+	if err != nil {
+		return err
+	}
+
+	// Check name and move the item back
+	var taken bool
+	switch item.Type {
+	case TrashFile:
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM files WHERE folder_id = ? AND display_name = ? AND deleted_at IS NULL)`, folderId, name).Scan(&taken); err != nil {
+			return err
+		}
+		if !taken {
+			_, err = db.Exec(`UPDATE files SET folder_id = ?, display_name = ?, deleted_at = NULL, trashed_from = NULL WHERE uuid = ?`, folderId, name, item.ID)
+		}
+	case TrashFolder:
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM folders WHERE parent_id = ? AND name = ?)`, folderId, name).Scan(&taken); err != nil {
+			return err
+		}
+		if !taken {
+			_, err = db.Exec(`UPDATE folders SET parent_id = ?, name = ?, deleted_at = NULL, trashed_from = NULL WHERE id = ?`, folderId, name, item.ID)
+		}
+	}
+	if taken || isUniqueViolation(err) {
+		return errRestoreConflict.withDetails(map[string]any{"path": path, "name": name})
+	}
+	return err
+}
+
+// purgeTrashItem deletes an item with all versions for good and releases its
+// quota. Purging a folder also purges files that were trashed from inside it.
+func purgeTrashItem(db *sql.DB, item TrashItem) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Files of the item with unfinished uploads of new versions
+	with, files := "", `WHERE ?1 IN (uuid, replaces)`
+	if item.Type == TrashFolder {
+		with, files = folderTree, `WHERE folder_id IN tree`
+	}
+	versions := `FROM file_versions WHERE file_uuid IN (SELECT uuid FROM files ` + files + `)`
+	storedNames, err := queryStrings(tx, with+`SELECT stored_name FROM files `+files+` UNION ALL SELECT stored_name `+versions, item.ID)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if err := tx.QueryRow(with+`SELECT (SELECT COALESCE(SUM(size_bytes), 0) FROM files `+files+`) + (SELECT COALESCE(SUM(size_bytes), 0) `+versions+`)`, item.ID).Scan(&size); err != nil {
+		return err
+	}
+
+	// Delete rows, versions are deleted with their file
+	if _, err := tx.Exec(with+`DELETE FROM files `+files, item.ID); err != nil {
+		return err
+	}
+	if item.Type == TrashFolder {
+		if _, err := tx.Exec(folderTree+`DELETE FROM folders WHERE id IN tree`, item.ID); err != nil {
+			return err
+		}
+	}
+	if err := releaseQuota(tx, item.OwnerID, size); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	releaseStoredFiles(db, storedNames)
+	return nil
+}
+
+// purgeExpiredTrash purges every item that is in the trash for longer than
+// the configured retention.
+func purgeExpiredTrash(db *sql.DB) error {
+	items, err := queryTrash(db, `deleted_at < ?`, time.Now().UTC().Add(-Conf.TrashRetention))
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := purgeTrashItem(db, item); err != nil {
+			return err
+		}
+	}
+	if len(items) > 0 {
+		log.Printf("Purged %d items from the trash", len(items))
+	}
+	return nil
+}
@@ -8,57 +8,117 @@ import (
 
 func getUserIdByLogin(db *sql.DB, username, password string) (int, error) {
 	var userId int
-	err := db.QueryRow("SELECT id FROM users WHERE username=? AND password=?", username, password).Scan(&userId)
-	return userId, err
+	var storedPassword string
+	if err := db.QueryRow("SELECT id, password FROM users WHERE username=? AND disabled=0", username).Scan(&userId, &storedPassword); err != nil {
+		// Spend the same time as for an existing user
+		verifyPassword(password, dummyPasswordHash())
+		return 0, err
+	}
+
+	// Check password
+	ok, needsRehash := verifyPassword(password, storedPassword)
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	// Upgrade plaintext or outdated hashes
+	if needsRehash {
+		if err := setUserPassword(db, userId, password); err != nil {
+			log.Printf("Couldnt rehash password of user %d: %s", userId, err.Error())
+		}
+	}
+
+	return userId, nil
+}
+
+func setUserPassword(db *sql.DB, userId int, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE users SET password = ? WHERE id = ?`, hash, userId)
+	return err
 }
 
 func createUser(db *sql.DB, inviteToken string, username, password string) error {
-	// Authenticate invite token
-	var validToken bool
-	errToken := db.QueryRow("SELECT EXISTS(SELECT 1 FROM invite_tokens WHERE token=?)", inviteToken).Scan(&validToken)
-	if errToken != nil {
-		log.Println("Error authenticating invite token")
-		return errToken
+	// Hash password
+	passwordHash, errHash := hashPassword(password)
+	if errHash != nil {
+		log.Println("Couldnt hash password")
+		return errHash
 	}
-	if !validToken {
-		log.Println("Invalid invite token")
-		return sql.ErrNoRows
+
+	// Redeem invite token and create user with its settings
+	if _, err := redeemInvite(db, inviteToken, username, passwordHash); err != nil {
+		if err == sql.ErrNoRows {
+			log.Println("Invalid invite token")
+		}
+		return err
 	}
 
+	return nil
+}
+
+// dbExecer is implemented by *sql.DB and *sql.Tx
+type dbExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertUser(db dbExecer, username, passwordHash, role string, quotaBytes int64) (int64, error) {
 	// Create user
-	result, errCreateUser := db.Exec(`INSERT INTO users (username, password, quota_bytes) VALUES (?, ?, ?)`, username, password, DefaultQuotaBytes)
+	result, errCreateUser := db.Exec(`INSERT INTO users (username, password, role, quota_bytes) VALUES (?, ?, ?, ?)`, username, passwordHash, role, quotaBytes)
+	if isUniqueViolation(errCreateUser) {
+		return 0, errUsernameTaken
+	}
 	if errCreateUser != nil {
 		log.Println("Couldnt create user")
-		return errCreateUser
+		return 0, errCreateUser
 	}
 	userId, errGetId := result.LastInsertId()
 	if errGetId != nil {
 		log.Println("Couldnt get users id")
-		return errGetId
+		return 0, errGetId
 	}
 
 	// Create root folder
 	if _, errCreateFolder := db.Exec(`INSERT INTO folders (owner_id, name) values (?, ?)`, userId, "~"); errCreateFolder != nil {
 		log.Println("Couldnt create users root folder")
-		return errCreateFolder
+		return 0, errCreateFolder
 	}
 
-	// Remove invite token
-	err := deleteInviteToken(db, inviteToken)
-	return err
+	return userId, nil
 }
 
-func deleteUser(db *sql.DB, authToken string) error {
-	// Authenticate auth token
-	userId, errAuth := authenticateUser(db, authToken)
-	if errAuth != nil {
-		log.Println("Invalid auth token")
-		return errAuth
+// deleteUser deletes a user with all files and folders, the trash included.
+func deleteUser(db *sql.DB, userId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	// Delete user
-	_, err := db.Exec(`DELETE FROM users WHERE id=?`, userId)
-	return err
+	// Remember the files to remove from disk
+	storedNames, err := queryStrings(tx, `SELECT stored_name FROM files WHERE owner_id=? UNION ALL SELECT stored_name FROM file_versions WHERE file_uuid IN (SELECT uuid FROM files WHERE owner_id=?)`, userId, userId)
+	if err != nil {
+		return err
+	}
+
+	// Delete files, folders and the user
+	for _, query := range []string{
+		`DELETE FROM files WHERE owner_id=?`,
+		`DELETE FROM folders WHERE owner_id=?`,
+		`DELETE FROM users WHERE id=?`,
+	} {
+		if _, err := tx.Exec(query, userId); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	releaseStoredFiles(db, storedNames)
+	return nil
 }
 
 func updateUser(db *sql.DB, userId int, username, password string) error {
@@ -71,6 +131,9 @@ func updateUser(db *sql.DB, userId int, username, password string) error {
 	}
 	if username != oldUsername {
 		_, errUpdUsername := db.Exec(`UPDATE users SET username = ? WHERE id = ?`, username, userId)
+		if isUniqueViolation(errUpdUsername) {
+			return errUsernameTaken
+		}
 		if errUpdUsername != nil {
 			log.Println("Couldnt update username")
 			return errUpdUsername
@@ -84,9 +147,8 @@ func updateUser(db *sql.DB, userId int, username, password string) error {
 		log.Println("Couldnt get old password")
 		return errPassword
 	}
-	if password != oldPassword {
-		_, errUpdPassword := db.Exec(`UPDATE users SET password = ? WHERE id = ?`, password, userId)
-		if errUpdPassword != nil {
+	if samePassword, _ := verifyPassword(password, oldPassword); !samePassword {
+		if errUpdPassword := setUserPassword(db, userId, password); errUpdPassword != nil {
 			log.Println("Couldnt update password")
 			return errUpdPassword
 		}
@@ -109,12 +171,12 @@ func reserveQuota(db *sql.DB, userID int, size int64) error {
 		return errors.New("reserveQuota rows affected error: " + err.Error())
 	}
 	if rows == 0 {
-		return errors.New("quota exceeded")
+		return errQuotaExceeded.withDetails(map[string]any{"requested_bytes": size})
 	}
 	return nil
 }
 
-func releaseQuota(db *sql.DB, userID int, size int64) error {
+func releaseQuota(db dbExecer, userID int, size int64) error {
 	_, err := db.Exec(`
         UPDATE users
         SET used_bytes = CASE
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+var errVersionNotFound = &APIError{Status: http.StatusNotFound, Code: "version_not_found", Message: "Version not found"}
+
+// archiveVersion copies the current version of a file to file_versions.
+func archiveVersion(tx *sql.Tx, fileUUID string) error {
+	_, err := tx.Exec(`INSERT INTO file_versions (file_uuid, version, stored_name, mime, size_bytes, sha256, author_id, created_at)
+		SELECT uuid, version, stored_name, mime, size_bytes, sha256, COALESCE(author_id, owner_id), COALESCE(updated_at, created_at) FROM files WHERE uuid = ?`, fileUUID)
+	return err
+}
+
+// pruneVersions deletes the oldest versions of a file beyond the configured
+// number and releases their quota. It returns the files to remove from disk.
+func pruneVersions(tx *sql.Tx, fileUUID string) ([]string, error) {
+	var ownerId int
+	if err := tx.QueryRow(`SELECT owner_id FROM files WHERE uuid = ?`, fileUUID).Scan(&ownerId); err != nil {
+		return nil, err
+	}
+
+	// Versions past the newest ones kept
+	const pruned = `SELECT id FROM file_versions WHERE file_uuid = ? ORDER BY version DESC LIMIT -1 OFFSET ?`
+	storedNames, err := queryStrings(tx, `SELECT stored_name FROM file_versions WHERE id IN (`+pruned+`)`, fileUUID, Conf.VersionsKept)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	if err := tx.QueryRow(`SELECT COALESCE(SUM(size_bytes), 0) FROM file_versions WHERE id IN (`+pruned+`)`, fileUUID, Conf.VersionsKept).Scan(&size); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM file_versions WHERE id IN (`+pruned+`)`, fileUUID, Conf.VersionsKept); err != nil {
+		return nil, err
+	}
+
+	return storedNames, releaseQuota(tx, ownerId, size)
+}
+
+// addVersion makes a finished upload the current version of the file it
+// replaces. The upload row is merged into the file, which keeps its uuid.
+func addVersion(db *sql.DB, fileUUID, uploadUUID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	storedNames, err := takeOverUpload(tx, fileUUID, uploadUUID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	releaseStoredFiles(db, storedNames)
+	return nil
+}
+
+// takeOverUpload merges the upload row into the file in tx. It returns the
+// stored names of versions beyond the limit, to release after the commit.
+func takeOverUpload(tx *sql.Tx, fileUUID, uploadUUID string) ([]string, error) {
+	// Keep the current version, then take over the upload
+	if err := archiveVersion(tx, fileUUID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE files SET (stored_name, mime, size_bytes, size_bytes_on_disk, sha256, author_id, updated_at) =
+		(SELECT stored_name, mime, size_bytes, size_bytes_on_disk, sha256, author_id, created_at FROM files WHERE uuid = ?), version = version + 1 WHERE uuid = ?`, uploadUUID, fileUUID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM files WHERE uuid = ?`, uploadUUID); err != nil {
+		return nil, err
+	}
+
+	// Drop versions beyond the limit
+	return pruneVersions(tx, fileUUID)
+}
+
+// listVersions returns every version of a file, the current one first.
+func listVersions(db *sql.DB, fileUUID string) ([]FileVersion, error) {
+	versions := make([]FileVersion, 0)
+
+	rows, err := db.Query(`SELECT f.version, 1, f.size_bytes, f.sha256, COALESCE(f.mime, ''), COALESCE(u.username, ''), COALESCE(f.updated_at, f.created_at) FROM files f LEFT JOIN users u ON u.id = COALESCE(f.author_id, f.owner_id) WHERE f.uuid = ?
+		UNION ALL
+		SELECT v.version, 0, v.size_bytes, v.sha256, COALESCE(v.mime, ''), COALESCE(u.username, ''), v.created_at FROM file_versions v LEFT JOIN users u ON u.id = v.author_id WHERE v.file_uuid = ?
+		ORDER BY 1 DESC`, fileUUID, fileUUID)
+	if err != nil {
+		log.Printf("Couldnt get versions: %s", err.Error())
+		return versions, err
+	}
+	defer rows.Close()
+
+	// Turn sql rows into structs
+	for rows.Next() {
+		var v FileVersion
+		var createdAt string
+		if err := rows.Scan(&v.Version, &v.Current, &v.SizeBytes, &v.Sha256, &v.Mime, &v.Author, &createdAt); err != nil {
+			log.Printf("Couldnt scan version rows: %s", err.Error())
+			return versions, err
+		}
+		v.CreatedAt, _ = parseDBTime(createdAt)
+		versions = append(versions, v)
+	}
+
+	return versions, rows.Err()
+}
+
+// getFileVersion opens an old version of a file for download.
+func getFileVersion(db *sql.DB, fileUUID string, version int) (StoredName string, Size int64, Mime string, SafeName string, ModTime time.Time, Err error) {
+	var storedName, displayName string
+	var mime sql.NullString
+	if err := db.QueryRow(`SELECT v.stored_name, v.mime, f.display_name FROM file_versions v JOIN files f ON f.uuid = v.file_uuid WHERE v.file_uuid = ? AND v.version = ?`, fileUUID, version).Scan(&storedName, &mime, &displayName); err != nil {
+		if err == sql.ErrNoRows {
+			return "", 0, "", "", time.Time{}, errVersionNotFound
+		}
+		return "", 0, "", "", time.Time{}, err
+	}
+
+	info, err := Store.Stat(storedName)
+	if err != nil {
+		log.Printf("Stat error: %s", err.Error())
+		return "", 0, "", "", time.Time{}, err
+	}
+
+	return storedName, info.Size, mime.String, filepath.Base(displayName), info.ModTime, nil
+}
+
+// restoreVersion makes an old version the new current version. It shares the
+// stored content but counts toward the quota like an upload.
+func restoreVersion(db *sql.DB, userId int, fileUUID string, version int) error {
+	// Get the version
+	var storedName, sha256 string
+	var mime sql.NullString
+	var size int64
+	if err := db.QueryRow(`SELECT stored_name, mime, size_bytes, sha256 FROM file_versions WHERE file_uuid = ? AND version = ?`, fileUUID, version).Scan(&storedName, &mime, &size, &sha256); err != nil {
+		if err == sql.ErrNoRows {
+			return errVersionNotFound
+		}
+		return err
+	}
+
+	// Keep the current version and make the old one current
+	if err := reserveQuota(db, userId, size); err != nil {
+		return err
+	}
+	if err := addRestoredVersion(db, userId, fileUUID, storedName, mime, size, sha256); err != nil {
+		releaseQuota(db, userId, size)
+		return err
+	}
+	return nil
+}
+
+func addRestoredVersion(db *sql.DB, userId int, fileUUID, storedName string, mime sql.NullString, size int64, sha256 string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := archiveVersion(tx, fileUUID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE files SET stored_name = ?, mime = ?, size_bytes = ?, size_bytes_on_disk = ?, sha256 = ?, author_id = ?, updated_at = ?, version = version + 1 WHERE uuid = ?`,
+		storedName, mime, size, size, sha256, userId, time.Now().UTC(), fileUUID); err != nil {
+		return err
+	}
+	storedNames, err := pruneVersions(tx, fileUUID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	releaseStoredFiles(db, storedNames)
+	return nil
+}
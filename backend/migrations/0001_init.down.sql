@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS files;
+DROP TABLE IF EXISTS folders;
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS oidc_states;
+DROP TABLE IF EXISTS user_identities;
+DROP TABLE IF EXISTS invite_redemptions;
+DROP TABLE IF EXISTS invite_tokens;
+DROP TABLE IF EXISTS personal_access_tokens;
+DROP TABLE IF EXISTS auth_tokens;
+DROP TABLE IF EXISTS mfa_tokens;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,156 @@
+-- Schema as of the introduction of versioned migrations. Tables are created
+-- only if missing, so databases set up by the old init.sql are adopted.
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT UNIQUE NOT NULL,
+	password TEXT NOT NULL,
+	role TEXT NOT NULL DEFAULT 'user',
+	quota_bytes INTEGER NOT NULL DEFAULT 0,
+	used_bytes INTEGER NOT NULL DEFAULT 0,
+	disabled INTEGER NOT NULL DEFAULT 0,
+	totp_secret TEXT,
+	totp_enabled INTEGER NOT NULL DEFAULT 0,
+	totp_last_step INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code TEXT NOT NULL,
+	used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS mfa_tokens (
+	token TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS auth_tokens (
+	token TEXT PRIMARY KEY,
+	refresh_token TEXT,
+	token_hashed INTEGER NOT NULL DEFAULT 0,
+	session_id TEXT,
+	user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	created_at DATETIME CURRENT_TIMESTAMP,
+	last_used_at DATETIME,
+	expires_at DATETIME NOT NULL,
+	refresh_expires_at DATETIME,
+	user_agent TEXT,
+	ip TEXT
+);
+
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+	id TEXT PRIMARY KEY,
+	token TEXT UNIQUE NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	scopes TEXT NOT NULL,
+	path TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_used_at DATETIME,
+	expires_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS invite_tokens (
+	token TEXT PRIMARY KEY,
+	token_hashed INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME CURRENT_TIMESTAMP,
+	expires_at DATETIME NOT NULL,
+	role TEXT NOT NULL DEFAULT 'user',
+	quota_bytes INTEGER NOT NULL DEFAULT 25000000000,
+	max_uses INTEGER NOT NULL DEFAULT 1,
+	uses INTEGER NOT NULL DEFAULT 0,
+	username TEXT NOT NULL DEFAULT '',
+	note TEXT NOT NULL DEFAULT '',
+	created_by INTEGER REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS invite_redemptions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	invite_token TEXT NOT NULL,
+	user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	redeemed_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (issuer, subject)
+);
+
+CREATE TABLE IF NOT EXISTS oidc_states (
+	state TEXT PRIMARY KEY,
+	nonce TEXT NOT NULL,
+	code_verifier TEXT NOT NULL,
+	link_user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+	expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL DEFAULT 0,
+	last_failure_at DATETIME NOT NULL,
+	locked_until DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+	id INTEGER PRIMARY KEY,
+	created_at TEXT NOT NULL,
+	actor_id INTEGER,
+	actor TEXT NOT NULL DEFAULT '',
+	action TEXT NOT NULL,
+	target TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	result TEXT NOT NULL,
+	prev_hash TEXT NOT NULL,
+	hash TEXT NOT NULL
+);
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+BEGIN
+	SELECT RAISE(ABORT, 'audit events are append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+BEGIN
+	SELECT RAISE(ABORT, 'audit events are append-only');
+END;
+
+CREATE TABLE IF NOT EXISTS folders (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	owner_id INTEGER NOT NULL REFERENCES users(id),
+	name TEXT NOT NULL,
+	parent_id INTEGER REFERENCES folders(id),
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(owner_id, parent_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS files (
+	uuid TEXT PRIMARY KEY,
+	owner_id INTEGER NOT NULL REFERENCES users(id),
+	folder_id INTEGER REFERENCES folders(id),
+	stored_name TEXT NOT NULL,
+	display_name TEXT NOT NULL,
+	mime TEXT,
+	size_bytes INTEGER NOT NULL,
+	size_bytes_on_disk INTEGER,
+	sha256 TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	deleted_at DATETIME NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_files_owner ON files(owner_id);
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_expiry ON auth_tokens(expires_at);
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user ON personal_access_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id);
+CREATE INDEX IF NOT EXISTS idx_invite_tokens_expiry ON invite_tokens(expires_at);
+CREATE INDEX IF NOT EXISTS idx_invite_redemptions_token ON invite_redemptions(invite_token);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events(actor);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events(action);
+CREATE INDEX IF NOT EXISTS idx_files_folder ON files(folder_id);
+CREATE INDEX IF NOT EXISTS idx_folders_parent ON folders(owner_id, parent_id);
\ No newline at end of file
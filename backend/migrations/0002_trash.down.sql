@@ -0,0 +1,9 @@
+-- Trashed files stay hidden by deleted_at. Trashed folders stay detached
+-- from their parent and cant be restored anymore.
+
+DROP INDEX IF EXISTS idx_folders_deleted;
+DROP INDEX IF EXISTS idx_files_deleted;
+
+ALTER TABLE files DROP COLUMN trashed_from;
+ALTER TABLE folders DROP COLUMN trashed_from;
+ALTER TABLE folders DROP COLUMN deleted_at;
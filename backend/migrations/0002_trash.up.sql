@@ -0,0 +1,10 @@
+-- Trash bin. Deleted files and folders keep their rows until they are
+-- purged, trashed_from is the folder they were deleted from. Trashed folders
+-- are detached from their parent, so their name can be used again.
+
+ALTER TABLE folders ADD COLUMN deleted_at DATETIME NULL;
+ALTER TABLE folders ADD COLUMN trashed_from TEXT NULL;
+ALTER TABLE files ADD COLUMN trashed_from TEXT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_files_deleted ON files(owner_id, deleted_at);
+CREATE INDEX IF NOT EXISTS idx_folders_deleted ON folders(owner_id, deleted_at);
@@ -0,0 +1,11 @@
+-- Old versions and unfinished version uploads are dropped, their files stay
+-- on disk.
+
+DROP INDEX IF EXISTS idx_files_replaces;
+DROP TABLE IF EXISTS file_versions;
+DELETE FROM files WHERE replaces IS NOT NULL;
+
+ALTER TABLE files DROP COLUMN replaces;
+ALTER TABLE files DROP COLUMN updated_at;
+ALTER TABLE files DROP COLUMN author_id;
+ALTER TABLE files DROP COLUMN version;
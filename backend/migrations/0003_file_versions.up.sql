@@ -0,0 +1,23 @@
+-- File versions. files keeps the current version of a file, older ones move
+-- to file_versions. An upload of a new version is a files row that replaces
+-- another file until it is finished.
+
+ALTER TABLE files ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE files ADD COLUMN author_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE files ADD COLUMN updated_at DATETIME NULL;
+ALTER TABLE files ADD COLUMN replaces TEXT NULL;
+
+CREATE TABLE IF NOT EXISTS file_versions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	file_uuid TEXT NOT NULL REFERENCES files(uuid) ON DELETE CASCADE,
+	version INTEGER NOT NULL,
+	stored_name TEXT NOT NULL,
+	mime TEXT,
+	size_bytes INTEGER NOT NULL,
+	sha256 TEXT NOT NULL,
+	author_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	created_at DATETIME NOT NULL,
+	UNIQUE(file_uuid, version)
+);
+
+CREATE INDEX IF NOT EXISTS idx_files_replaces ON files(replaces);
@@ -0,0 +1,16 @@
+-- Stored files stay where they are. Files sharing a blob keep pointing to
+-- it, deleting one of them removes the content of the others.
+
+DROP TRIGGER IF EXISTS blobs_file_versions_delete;
+DROP TRIGGER IF EXISTS blobs_file_versions_insert;
+DROP TRIGGER IF EXISTS blobs_files_delete;
+DROP TRIGGER IF EXISTS blobs_files_update;
+DROP TRIGGER IF EXISTS blobs_files_insert;
+DROP TRIGGER IF EXISTS blobs_file_versions_insert_check;
+DROP TRIGGER IF EXISTS blobs_files_update_check;
+DROP TRIGGER IF EXISTS blobs_files_insert_check;
+DROP INDEX IF EXISTS idx_file_versions_stored_name;
+DROP INDEX IF EXISTS idx_files_stored_name;
+DROP INDEX IF EXISTS idx_blobs_unreferenced;
+DROP INDEX IF EXISTS idx_blobs_sha256;
+DROP TABLE IF EXISTS blobs;
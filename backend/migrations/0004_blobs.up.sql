@@ -0,0 +1,62 @@
+-- Content addressed storage. Files and versions with the same content share
+-- one stored file, a blob. Triggers count the rows using a blob, blobs
+-- without references are removed by the server.
+
+CREATE TABLE IF NOT EXISTS blobs (
+	stored_name TEXT PRIMARY KEY,
+	sha256 TEXT NOT NULL,
+	size_bytes INTEGER NOT NULL,
+	refs INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_blobs_sha256 ON blobs(sha256);
+CREATE INDEX IF NOT EXISTS idx_blobs_unreferenced ON blobs(refs) WHERE refs <= 0;
+CREATE INDEX IF NOT EXISTS idx_files_stored_name ON files(stored_name);
+CREATE INDEX IF NOT EXISTS idx_file_versions_stored_name ON file_versions(stored_name);
+
+-- Files stored before are blobs of their own
+INSERT INTO blobs (stored_name, sha256, size_bytes, refs)
+SELECT stored_name, MIN(sha256), MIN(size_bytes), COUNT(*) FROM (
+	SELECT stored_name, sha256, size_bytes FROM files WHERE stored_name NOT LIKE '%.part'
+	UNION ALL
+	SELECT stored_name, sha256, size_bytes FROM file_versions
+) GROUP BY stored_name;
+
+-- Rows can only use blobs that werent removed, unfinished uploads have their
+-- own .part file
+CREATE TRIGGER IF NOT EXISTS blobs_files_insert_check BEFORE INSERT ON files
+WHEN NEW.stored_name NOT LIKE '%.part' AND NOT EXISTS (SELECT 1 FROM blobs WHERE stored_name = NEW.stored_name) BEGIN
+	SELECT RAISE(ABORT, 'stored file is gone');
+END;
+
+CREATE TRIGGER IF NOT EXISTS blobs_files_update_check BEFORE UPDATE OF stored_name ON files
+WHEN NOT EXISTS (SELECT 1 FROM blobs WHERE stored_name = NEW.stored_name) BEGIN
+	SELECT RAISE(ABORT, 'stored file is gone');
+END;
+
+CREATE TRIGGER IF NOT EXISTS blobs_file_versions_insert_check BEFORE INSERT ON file_versions
+WHEN NOT EXISTS (SELECT 1 FROM blobs WHERE stored_name = NEW.stored_name) BEGIN
+	SELECT RAISE(ABORT, 'stored file is gone');
+END;
+
+CREATE TRIGGER IF NOT EXISTS blobs_files_insert AFTER INSERT ON files BEGIN
+	UPDATE blobs SET refs = refs + 1 WHERE stored_name = NEW.stored_name;
+END;
+
+CREATE TRIGGER IF NOT EXISTS blobs_files_update AFTER UPDATE OF stored_name ON files WHEN NEW.stored_name IS NOT OLD.stored_name BEGIN
+	UPDATE blobs SET refs = refs - 1 WHERE stored_name = OLD.stored_name;
+	UPDATE blobs SET refs = refs + 1 WHERE stored_name = NEW.stored_name;
+END;
+
+CREATE TRIGGER IF NOT EXISTS blobs_files_delete AFTER DELETE ON files BEGIN
+	UPDATE blobs SET refs = refs - 1 WHERE stored_name = OLD.stored_name;
+END;
+
+CREATE TRIGGER IF NOT EXISTS blobs_file_versions_insert AFTER INSERT ON file_versions BEGIN
+	UPDATE blobs SET refs = refs + 1 WHERE stored_name = NEW.stored_name;
+END;
+
+CREATE TRIGGER IF NOT EXISTS blobs_file_versions_delete AFTER DELETE ON file_versions BEGIN
+	UPDATE blobs SET refs = refs - 1 WHERE stored_name = OLD.stored_name;
+END;
@@ -0,0 +1,5 @@
+-- The data keys are lost, encrypted blobs cant be read anymore. Decrypt them
+-- with `drive storage decrypt` before.
+
+DROP INDEX IF EXISTS idx_blob_keys_key_id;
+DROP TABLE IF EXISTS blob_keys;
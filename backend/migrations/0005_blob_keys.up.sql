@@ -0,0 +1,13 @@
+-- Encryption at rest. Every encrypted blob has a data key of its own, stored
+-- wrapped with a master key, so master keys can be rotated without
+-- rewriting blobs. Blobs without a row are stored in plain.
+
+CREATE TABLE IF NOT EXISTS blob_keys (
+	stored_name TEXT PRIMARY KEY,
+	key_id TEXT NOT NULL,
+	wrapped_key BLOB NOT NULL,
+	size_bytes INTEGER NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_blob_keys_key_id ON blob_keys(key_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_files_upload_expires_at;
+ALTER TABLE files DROP COLUMN upload_expires_at;
@@ -0,0 +1,8 @@
+-- Unfinished uploads expire a while after their last chunk, the server
+-- removes them and releases their quota. Finished files have no expiry.
+
+ALTER TABLE files ADD COLUMN upload_expires_at DATETIME NULL;
+
+UPDATE files SET upload_expires_at = datetime('now', '+1 day') WHERE stored_name LIKE '%.part';
+
+CREATE INDEX IF NOT EXISTS idx_files_upload_expires_at ON files(upload_expires_at) WHERE upload_expires_at IS NOT NULL;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_auth_tokens_user;
+DROP INDEX IF EXISTS idx_auth_tokens_refresh;
+DROP INDEX IF EXISTS idx_auth_tokens_session;
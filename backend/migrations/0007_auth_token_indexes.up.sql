@@ -0,0 +1,7 @@
+-- Session and refresh tokens are looked up by value and must be unique, a
+-- rotated refresh token must never match two sessions. Databases upgraded
+-- from init.sql had these indexes already.
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_auth_tokens_session ON auth_tokens(session_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_auth_tokens_refresh ON auth_tokens(refresh_token);
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_user ON auth_tokens(user_id);
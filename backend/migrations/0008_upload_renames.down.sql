@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS blobs_files_update_check;
+
+CREATE TRIGGER IF NOT EXISTS blobs_files_update_check BEFORE UPDATE OF stored_name ON files
+WHEN NOT EXISTS (SELECT 1 FROM blobs WHERE stored_name = NEW.stored_name) BEGIN
+	SELECT RAISE(ABORT, 'stored file is gone');
+END;
@@ -0,0 +1,9 @@
+-- Unfinished uploads have no blob, like on insert they can be renamed without
+-- one. Uploads stored under legacy names are renamed to their key.
+
+DROP TRIGGER IF EXISTS blobs_files_update_check;
+
+CREATE TRIGGER IF NOT EXISTS blobs_files_update_check BEFORE UPDATE OF stored_name ON files
+WHEN NEW.stored_name NOT LIKE '%.part' AND NOT EXISTS (SELECT 1 FROM blobs WHERE stored_name = NEW.stored_name) BEGIN
+	SELECT RAISE(ABORT, 'stored file is gone');
+END;
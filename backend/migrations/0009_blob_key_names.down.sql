@@ -0,0 +1,4 @@
+-- Blobs encrypted with bound keys cant be read after this, decrypt them
+-- first.
+
+ALTER TABLE blob_keys DROP COLUMN bound;
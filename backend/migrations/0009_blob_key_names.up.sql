@@ -0,0 +1,5 @@
+-- Data keys and the chunks they encrypt are bound to the name of their blob,
+-- so keys and content cant be swapped between blobs. Keys stored before
+-- arent bound and are read as they were.
+
+ALTER TABLE blob_keys ADD COLUMN bound INTEGER NOT NULL DEFAULT 0;
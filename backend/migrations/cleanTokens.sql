@@ -1,3 +1,5 @@
-DELETE FROM auth_tokens WHERE expires_at < CURRENT_TIMESTAMP;
+DELETE FROM auth_tokens WHERE COALESCE(refresh_expires_at, expires_at) < CURRENT_TIMESTAMP;
 DELETE FROM auth_tokens WHERE user_id IS NULL;
-DELETE FROM invite_tokens WHERE expires_at < CURRENT_TIMESTAMP;
\ No newline at end of file
+DELETE FROM invite_tokens WHERE expires_at < CURRENT_TIMESTAMP AND uses = 0;
+DELETE FROM mfa_tokens WHERE expires_at < CURRENT_TIMESTAMP;
+DELETE FROM oidc_states WHERE expires_at < CURRENT_TIMESTAMP;
\ No newline at end of file
@@ -1,17 +1,15 @@
+-- Development users, applied with `go run ./cmd/ seed`. Never run this on a
+-- real instance.
 INSERT OR IGNORE INTO users (username, password, quota_bytes)
 VALUES ('danya', 'joemama', 25000000000);
 
-INSERT OR IGNORE INTO folders (owner_id, name) 
-VALUES (1, '~');
-
 INSERT OR IGNORE INTO users (username, password, quota_bytes, role)
 VALUES ('andrii', 'ligma', 50000000000, 'admin');
 
-INSERT OR IGNORE INTO folders (owner_id, name) 
-VALUES (2, '~');
-
 INSERT OR IGNORE INTO users (username, password, quota_bytes)
 VALUES ('max', 'mamka', 25000000000);
 
-INSERT OR IGNORE INTO folders (owner_id, name) 
-VALUES (3, '~');
\ No newline at end of file
+INSERT INTO folders (owner_id, name)
+SELECT id, '~' FROM users
+WHERE username IN ('danya', 'andrii', 'max')
+AND NOT EXISTS (SELECT 1 FROM folders WHERE owner_id = users.id AND parent_id IS NULL);
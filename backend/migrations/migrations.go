@@ -0,0 +1,20 @@
+// Package migrations embeds the sql files into the binary, so the server
+// doesnt depend on the directory it is started from.
+//
+// Schema changes are numbered files NNNN_name.up.sql with an optional
+// NNNN_name.down.sql that reverts them. Never edit a migration that was
+// released, add a new one instead.
+package migrations
+
+import "embed"
+
+//go:embed [0-9]*.sql
+var FS embed.FS
+
+// Dummy holds development users, it is only applied by the seed command.
+//
+//go:embed dummy.sql
+var Dummy string
+
+//go:embed cleanTokens.sql
+var CleanTokens string